@@ -0,0 +1,323 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+var ErrAuth = errors.New("请求认证配置错误")
+
+// headerName 合法的请求头名（RFC 7230 token）
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// secretName 合法的密钥名，需能在表达式中以 secret.<name> 引用
+var secretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// secretRef 仅引用一个流程密钥的模板，如 {{ secret.api_token }}，不含明文凭据
+var secretRef = regexp.MustCompile(`^\s*\{\{\s*secret\.[A-Za-z_][A-Za-z0-9_]*\s*\}\}\s*$`)
+
+// MaskedCredential 返回给读取方的凭据占位值；保存时原样提交表示沿用已保存的凭据
+const MaskedCredential = "••••••••"
+
+// Header 请求头；Value 支持 {{ }} 模板，可引用 secret.<name>
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Auth 请求认证方式；各字段支持 {{ }} 模板，密钥类字段应通过 secret.<name> 引用流程密钥而非直接填写明文
+type Auth struct {
+	Type            string `json:"type"`                      // none | bearer | basic | hmac，节点设为 none 可关闭流程级认证
+	Token           string `json:"token,omitempty"`           // bearer 令牌
+	Username        string `json:"username,omitempty"`        // basic 用户名
+	Password        string `json:"password,omitempty"`        // basic 密码
+	Secret          string `json:"secret,omitempty"`          // hmac 签名密钥
+	Algorithm       string `json:"algorithm,omitempty"`       // hmac 摘要算法：sha256（默认）| sha1 | sha512
+	Header          string `json:"header,omitempty"`          // hmac 签名写入的请求头，默认 X-Signature
+	TimestampHeader string `json:"timestampHeader,omitempty"` // hmac 时间戳请求头，默认 X-Timestamp
+}
+
+// ParseHeaders 解析并校验请求头配置
+func ParseHeaders(raw string) ([]Header, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var headers []Header
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		return nil, fmt.Errorf("请求头格式错误: %w", err)
+	}
+	for i, h := range headers {
+		if !headerName.MatchString(h.Name) {
+			return nil, fmt.Errorf("第 %d 个请求头名无效: %q", i+1, h.Name)
+		}
+	}
+	return headers, nil
+}
+
+// ParseAuth 解析并校验认证配置，未配置时返回 nil
+func ParseAuth(raw string) (*Auth, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var a Auth
+	if err := json.Unmarshal([]byte(raw), &a); err != nil {
+		return nil, fmt.Errorf("认证配置格式错误: %w", err)
+	}
+	if a.Type == "" {
+		return nil, nil
+	}
+	return &a, a.Validate()
+}
+
+// Validate 校验认证配置
+func (a *Auth) Validate() error {
+	switch a.Type {
+	case "none":
+	case "bearer":
+		if a.Token == "" {
+			return errors.New("bearer 认证缺少 token")
+		}
+	case "basic":
+		if a.Username == "" {
+			return errors.New("basic 认证缺少 username")
+		}
+	case "hmac":
+		if a.Secret == "" {
+			return errors.New("hmac 认证缺少 secret")
+		}
+		if _, err := hmacHash(a.Algorithm); err != nil {
+			return err
+		}
+		for _, h := range []string{a.Header, a.TimestampHeader} {
+			if h != "" && !headerName.MatchString(h) {
+				return fmt.Errorf("hmac 请求头名无效: %q", h)
+			}
+		}
+	default:
+		return fmt.Errorf("未知的认证方式 %q", a.Type)
+	}
+	return nil
+}
+
+// Masked 返回脱敏后的副本：令牌、密码与签名密钥只保留对流程密钥的引用，直接填写的明文替换为 MaskedCredential
+func (a *Auth) Masked() *Auth {
+	if a == nil {
+		return nil
+	}
+	m := *a
+	for _, f := range m.credentials() {
+		if *f != "" && !secretRef.MatchString(*f) {
+			*f = MaskedCredential
+		}
+	}
+	return &m
+}
+
+// KeepMasked 把提交中仍为 MaskedCredential 的凭据还原为 stored 中已保存的值；没有可沿用的值时返回错误
+func (a *Auth) KeepMasked(stored *Auth) error {
+	var prev []*string
+	if stored != nil {
+		prev = stored.credentials()
+	}
+	for i, f := range a.credentials() {
+		if *f != MaskedCredential {
+			continue
+		}
+		if prev == nil || *prev[i] == "" {
+			return errors.New("认证凭据已脱敏，请重新填写或改用 secret.<name> 引用流程密钥")
+		}
+		*f = *prev[i]
+	}
+	return nil
+}
+
+func (a *Auth) credentials() []*string {
+	return []*string{&a.Token, &a.Password, &a.Secret}
+}
+
+func hmacHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("不支持的 hmac 算法 %q", algorithm)
+}
+
+// ValidSecretName 密钥名是否合法
+func ValidSecretName(name string) bool {
+	return secretName.MatchString(name)
+}
+
+// MaskSecret 脱敏展示密钥值
+func MaskSecret(v string) string {
+	if len(v) <= 8 {
+		return "••••••••"
+	}
+	return "••••••••" + v[len(v)-4:]
+}
+
+// Secrets 返回流程密钥，供请求头与认证模板以 secret.<name> 引用
+func (e *Engine) Secrets(tx *gorm.DB, smID int64) map[string]any {
+	var rows []orm.SMSecret
+	tx.Where("sm_id = ?", smID).Find(&rows)
+	secrets := make(map[string]any, len(rows))
+	for _, r := range rows {
+		secrets[r.Name] = r.Value
+	}
+	return secrets
+}
+
+// HMACSigner 已渲染的 HMAC 签名参数；签名内容为
+// METHOD + "\n" + 请求 URI（含查询串）+ "\n" + 时间戳（Unix 秒）+ "\n" + 请求体，结果为十六进制
+type HMACSigner struct {
+	Key             []byte
+	Algorithm       string
+	Header          string
+	TimestampHeader string
+}
+
+// Sign 为请求计算签名并写入请求头；每次尝试（含重试）重新签名
+func (s *HMACSigner) Sign(r *http.Request, body string, now time.Time) {
+	newHash, err := hmacHash(s.Algorithm)
+	if err != nil {
+		newHash = sha256.New
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(newHash, s.Key)
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + ts + "\n" + body))
+	header, tsHeader := s.Header, s.TimestampHeader
+	if header == "" {
+		header = "X-Signature"
+	}
+	if tsHeader == "" {
+		tsHeader = "X-Timestamp"
+	}
+	r.Header.Set(tsHeader, ts)
+	r.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// resolveHeaders 合并流程级与节点级请求头，节点同名请求头覆盖流程级，值为空时去掉该请求头
+func resolveHeaders(flow *orm.SMFlow, node *orm.SMNode) []Header {
+	var merged []Header
+	index := map[string]int{}
+	add := func(raw string) {
+		headers, _ := ParseHeaders(raw)
+		for _, h := range headers {
+			key := http.CanonicalHeaderKey(h.Name)
+			if i, ok := index[key]; ok {
+				merged[i] = h
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, h)
+		}
+	}
+	if flow != nil {
+		add(flow.Headers)
+	}
+	if node != nil {
+		add(node.Headers)
+	}
+	return merged
+}
+
+// resolveAuth 节点配置了认证方式时使用节点的，否则使用流程的；格式错误的配置按未设置处理
+func resolveAuth(flow *orm.SMFlow, node *orm.SMNode) *Auth {
+	if node != nil {
+		if a, err := ParseAuth(node.Auth); err == nil && a != nil {
+			return a
+		}
+	}
+	if flow != nil {
+		if a, err := ParseAuth(flow.Auth); err == nil && a != nil {
+			return a
+		}
+	}
+	return nil
+}
+
+// Authorize 渲染流程与节点的请求头和认证配置并写入 req；
+// 模板在 scope 之外还可引用 secret（流程密钥），密钥只用于请求头，不进入请求体与会话历史
+func (e *Engine) Authorize(tx *gorm.DB, req *Request, flow *orm.SMFlow, node *orm.SMNode, scope map[string]any) error {
+	headers := resolveHeaders(flow, node)
+	auth := resolveAuth(flow, node)
+	if len(headers) == 0 && auth == nil {
+		return nil
+	}
+	withSecrets := make(map[string]any, len(scope)+1)
+	for k, v := range scope {
+		withSecrets[k] = v
+	}
+	withSecrets["secret"] = e.Secrets(tx, flow.ID)
+	render := func(s string) (string, error) {
+		return Render(s, withSecrets, nil)
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, h := range headers {
+		v, err := render(h.Value)
+		if err != nil {
+			return err
+		}
+		if v == "" {
+			req.Header.Del(h.Name)
+			continue
+		}
+		req.Header.Set(h.Name, v)
+	}
+	if auth == nil {
+		return nil
+	}
+	switch auth.Type {
+	case "bearer":
+		token, err := render(auth.Token)
+		if err != nil {
+			return err
+		}
+		if token == "" {
+			return fmt.Errorf("%w: bearer token 为空", ErrAuth)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		user, err := render(auth.Username)
+		if err != nil {
+			return err
+		}
+		pass, err := render(auth.Password)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	case "hmac":
+		key, err := render(auth.Secret)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			return fmt.Errorf("%w: hmac secret 为空", ErrAuth)
+		}
+		req.Signer = &HMACSigner{Key: []byte(key), Algorithm: auth.Algorithm, Header: auth.Header, TimestampHeader: auth.TimestampHeader}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package engine
+
+import "testing"
+
+func TestAuthMasked(t *testing.T) {
+	a := &Auth{Type: "basic", Username: "bob", Password: "p@ss", Token: "{{ secret.api_token }}", Secret: "Bearer {{ secret.k }}"}
+	m := a.Masked()
+	if m.Username != "bob" || m.Password != MaskedCredential {
+		t.Fatalf("明文密码应脱敏，用户名保留: %+v", m)
+	}
+	if m.Token != "{{ secret.api_token }}" {
+		t.Fatalf("仅引用密钥的模板应原样返回: %q", m.Token)
+	}
+	if m.Secret != MaskedCredential {
+		t.Fatalf("混有明文的模板应脱敏: %q", m.Secret)
+	}
+	if a.Password != "p@ss" {
+		t.Fatal("Masked 不应修改原配置")
+	}
+	if (*Auth)(nil).Masked() != nil {
+		t.Fatal("未配置认证时应返回 nil")
+	}
+}
+
+func TestAuthKeepMasked(t *testing.T) {
+	stored := &Auth{Type: "bearer", Token: "tok-123"}
+	a := stored.Masked()
+	if err := a.KeepMasked(stored); err != nil || a.Token != "tok-123" {
+		t.Fatalf("脱敏值应还原为已保存的凭据: %q, %v", a.Token, err)
+	}
+
+	a = &Auth{Type: "bearer", Token: "new-token"}
+	if err := a.KeepMasked(stored); err != nil || a.Token != "new-token" {
+		t.Fatalf("新填写的凭据应覆盖已保存的值: %q, %v", a.Token, err)
+	}
+
+	a = &Auth{Type: "hmac", Secret: MaskedCredential}
+	if err := a.KeepMasked(stored); err == nil {
+		t.Fatal("没有可沿用的凭据时应返回错误")
+	}
+	if err := a.KeepMasked(nil); err == nil {
+		t.Fatal("尚未保存认证配置时提交脱敏值应返回错误")
+	}
+}
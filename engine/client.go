@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+const (
+	defaultTimeout      = 30 * time.Second
+	defaultRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff     = 10 * time.Second
+	maxRetries          = 10
+)
+
+// HTTPOptions 出站 HTTP 客户端配置；流程级（SMFlow.HTTPOptions）为默认值，节点级（SMNode.HTTPOptions）逐项覆盖
+type HTTPOptions struct {
+	TimeoutMs          *int    `json:"timeoutMs,omitempty"`          // 单次请求超时，默认 30000
+	Retries            *int    `json:"retries,omitempty"`            // 遇到网络错误或 5xx 时的重试次数，默认 0
+	RetryBackoffMs     *int    `json:"retryBackoffMs,omitempty"`     // 首次重试前等待，之后每次翻倍，默认 500
+	InsecureSkipVerify *bool   `json:"insecureSkipVerify,omitempty"` // 跳过 TLS 证书校验
+	CACert             *string `json:"caCert,omitempty"`             // 额外信任的 CA 证书（PEM）
+	Proxy              *string `json:"proxy,omitempty"`              // 代理地址，如 http://127.0.0.1:7890
+}
+
+// ParseHTTPOptions 解析并校验 HTTP 配置
+func ParseHTTPOptions(raw string) (HTTPOptions, error) {
+	var o HTTPOptions
+	if strings.TrimSpace(raw) == "" {
+		return o, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &o); err != nil {
+		return o, fmt.Errorf("HTTP 配置格式错误: %w", err)
+	}
+	return o, o.Validate()
+}
+
+// Validate 校验配置取值
+func (o HTTPOptions) Validate() error {
+	if o.TimeoutMs != nil && *o.TimeoutMs < 0 {
+		return errors.New("timeoutMs 不能为负数")
+	}
+	if o.Retries != nil && (*o.Retries < 0 || *o.Retries > maxRetries) {
+		return fmt.Errorf("retries 取值范围为 0-%d", maxRetries)
+	}
+	if o.RetryBackoffMs != nil && *o.RetryBackoffMs < 0 {
+		return errors.New("retryBackoffMs 不能为负数")
+	}
+	if o.CACert != nil && *o.CACert != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(*o.CACert)) {
+			return errors.New("caCert 不是有效的 PEM 证书")
+		}
+	}
+	if o.Proxy != nil && *o.Proxy != "" {
+		if u, err := url.Parse(*o.Proxy); err != nil || u.Host == "" {
+			return errors.New("proxy 不是有效的地址")
+		}
+	}
+	return nil
+}
+
+// Merge 用 override 中已设置的项覆盖 o
+func (o HTTPOptions) Merge(override HTTPOptions) HTTPOptions {
+	if override.TimeoutMs != nil {
+		o.TimeoutMs = override.TimeoutMs
+	}
+	if override.Retries != nil {
+		o.Retries = override.Retries
+	}
+	if override.RetryBackoffMs != nil {
+		o.RetryBackoffMs = override.RetryBackoffMs
+	}
+	if override.InsecureSkipVerify != nil {
+		o.InsecureSkipVerify = override.InsecureSkipVerify
+	}
+	if override.CACert != nil {
+		o.CACert = override.CACert
+	}
+	if override.Proxy != nil {
+		o.Proxy = override.Proxy
+	}
+	return o
+}
+
+// ResolveHTTPOptions 合并流程级与节点级配置；格式错误的配置按未设置处理
+func ResolveHTTPOptions(flow *orm.SMFlow, node *orm.SMNode) HTTPOptions {
+	var o HTTPOptions
+	if flow != nil {
+		o, _ = ParseHTTPOptions(flow.HTTPOptions)
+	}
+	if node != nil {
+		n, _ := ParseHTTPOptions(node.HTTPOptions)
+		o = o.Merge(n)
+	}
+	return o
+}
+
+func (o HTTPOptions) timeout() time.Duration {
+	if o.TimeoutMs == nil || *o.TimeoutMs == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(*o.TimeoutMs) * time.Millisecond
+}
+
+func (o HTTPOptions) retries() int {
+	if o.Retries == nil {
+		return 0
+	}
+	return *o.Retries
+}
+
+// backoff 第 attempt 次重试（从 1 开始）前的等待时间
+func (o HTTPOptions) backoff(attempt int) time.Duration {
+	base := defaultRetryBackoff
+	if o.RetryBackoffMs != nil {
+		base = time.Duration(*o.RetryBackoffMs) * time.Millisecond
+	}
+	d := base << (attempt - 1)
+	if d > maxRetryBackoff || d < 0 {
+		d = maxRetryBackoff
+	}
+	return d
+}
+
+// transportKey 影响连接建立的配置项，相同配置复用同一个 Transport
+func (o HTTPOptions) transportKey() string {
+	h := sha256.New()
+	if o.InsecureSkipVerify != nil && *o.InsecureSkipVerify {
+		h.Write([]byte("insecure\x00"))
+	}
+	if o.CACert != nil {
+		h.Write([]byte(*o.CACert))
+	}
+	h.Write([]byte{0})
+	if o.Proxy != nil {
+		h.Write([]byte(*o.Proxy))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// transports 按配置缓存的 Transport，保证连接复用
+type transports struct {
+	mu sync.Mutex
+	m  map[string]*http.Transport
+}
+
+func (t *transports) get(o HTTPOptions) (*http.Transport, error) {
+	key := o.transportKey()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr, ok := t.m[key]; ok {
+		return tr, nil
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if o.InsecureSkipVerify != nil && *o.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if o.CACert != nil && *o.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(*o.CACert)) {
+			return nil, errors.New("caCert 不是有效的 PEM 证书")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	tr.TLSClientConfig = tlsConfig
+	if o.Proxy != nil && *o.Proxy != "" {
+		proxyURL, err := url.Parse(*o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy 不是有效的地址: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	if t.m == nil {
+		t.m = map[string]*http.Transport{}
+	}
+	t.m[key] = tr
+	return tr, nil
+}
+
+// Attempt 一次请求尝试的记录
+type Attempt struct {
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// RequestError 所有尝试均失败（网络错误，或最后一次尝试仍为 5xx）时返回，携带每次尝试的记录
+type RequestError struct {
+	Attempts []Attempt
+	Response *Response // 最后一次尝试返回 5xx 时的响应，网络错误时为 nil
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrRequestFailed.Error(), e.Err)
+}
+
+func (e *RequestError) Unwrap() error { return ErrRequestFailed }
+
+// EncodeAttempts 序列化尝试记录，只有一次尝试时返回空串
+func EncodeAttempts(attempts []Attempt) string {
+	if len(attempts) <= 1 {
+		return ""
+	}
+	b, _ := json.Marshal(attempts)
+	return string(b)
+}
+
+// DecodeAttempts 反序列化尝试记录，为空或格式错误时返回空数组
+func DecodeAttempts(raw string) []Attempt {
+	attempts := []Attempt{}
+	if raw != "" {
+		_ = json.Unmarshal([]byte(raw), &attempts)
+	}
+	return attempts
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+// DecodeContext 解析 SessionInfo.Context，空值或格式错误时返回空对象
+func DecodeContext(raw string) map[string]any {
+	vars := map[string]any{}
+	if strings.TrimSpace(raw) != "" {
+		_ = json.Unmarshal([]byte(raw), &vars)
+	}
+	if vars == nil {
+		vars = map[string]any{}
+	}
+	return vars
+}
+
+// EncodeContext 序列化会话变量
+func EncodeContext(vars map[string]any) string {
+	if vars == nil {
+		return "{}"
+	}
+	b, err := json.Marshal(vars)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// MergePatch 按 JSON Merge Patch（RFC 7386）语义将 patch 合并进 dst：
+// 值为 null 删除键，对象递归合并，其余直接覆盖
+func MergePatch(dst, patch map[string]any) map[string]any {
+	if dst == nil {
+		dst = map[string]any{}
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		if pv, ok := v.(map[string]any); ok {
+			dv, _ := dst[k].(map[string]any)
+			dst[k] = MergePatch(dv, pv)
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// PatchContext 在事务中按 Merge Patch 更新会话变量并将版本加一，返回更新后的会话；
+// expectedVersion 不为 0 时校验会话版本。与 Fire 共用会话执行队列，不会与正在执行的事件互相覆盖
+func (e *Engine) PatchContext(ctx context.Context, sessionID int64, patch map[string]any, expectedVersion int64) (*orm.SessionInfo, error) {
+	s, err := e.LoadSession(e.db, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var session *orm.SessionInfo
+	if qerr := e.queue.Do(ctx, sessionKey(s.SMID, s.LogicalSessionID), func() {
+		session, err = e.patchContext(sessionID, patch, expectedVersion)
+	}); qerr != nil {
+		return nil, qerr
+	}
+	return session, err
+}
+
+func (e *Engine) patchContext(sessionID int64, patch map[string]any, expectedVersion int64) (*orm.SessionInfo, error) {
+	var session *orm.SessionInfo
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if session, err = e.LoadSession(tx, sessionID); err != nil {
+			return err
+		}
+		if err := checkVersion(session, expectedVersion); err != nil {
+			return err
+		}
+		vars := EncodeContext(MergePatch(DecodeContext(session.Context), patch))
+		if err := updateSession(tx, session, map[string]interface{}{"context": vars}); err != nil {
+			return err
+		}
+		session.Context = vars
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
@@ -0,0 +1,231 @@
+// Package engine 状态迁移引擎：沿 SMEdge 推进 SessionInfo 的当前状态，并记录 SessionDetail
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionNotFound = errors.New("会话不存在")
+	ErrNodeNotFound    = errors.New("节点不存在或未保存到流程")
+	ErrNoStartNode     = errors.New("流程缺少开始节点")
+	ErrNoTransition    = errors.New("当前节点没有可用的出边")
+	ErrAmbiguous       = errors.New("当前节点存在多条出边，需指定目标节点")
+	ErrInvalidTarget   = errors.New("当前节点与目标节点之间没有连线")
+	ErrUnknownExecutor = errors.New("未注册的节点执行器")
+	ErrScript          = errors.New("脚本执行失败")
+	ErrVersionConflict = errors.New("会话版本冲突")
+)
+
+// Engine 状态迁移引擎，持有数据库句柄与节点执行器注册表
+type Engine struct {
+	db          *gorm.DB
+	executors   *executors
+	transports  *transports
+	bus         *Bus
+	queue       *Queue
+	webhookWake chan struct{} // 生成 Webhook 投递记录后唤醒投递协程
+}
+
+// New 基于给定 DB 创建引擎，并注册内置执行器；会话执行队列按 LoadQueueConfig 配置
+func New(db *gorm.DB) *Engine {
+	return &Engine{
+		db:          db,
+		executors:   newExecutors(),
+		transports:  &transports{},
+		bus:         newBus(),
+		queue:       NewQueue(LoadQueueConfig()),
+		webhookWake: make(chan struct{}, 1),
+	}
+}
+
+var (
+	defaultEngine *Engine
+	defaultOnce   sync.Once
+)
+
+// Default 返回使用 orm.DB() 的全局引擎，首次调用时创建
+func Default() *Engine {
+	defaultOnce.Do(func() { defaultEngine = New(orm.DB()) })
+	return defaultEngine
+}
+
+// DB 返回引擎使用的 GORM 实例
+func (e *Engine) DB() *gorm.DB {
+	return e.db
+}
+
+// Queue 返回会话执行队列
+func (e *Engine) Queue() *Queue {
+	return e.queue
+}
+
+// Transition 一次状态迁移的描述
+type Transition struct {
+	Event        string         // 触发事件名
+	Target       string         // 目标节点 id；为空时取当前节点唯一的出边
+	Force        bool           // 跳过出边校验（调用方已校验，或设计页单步运行节点）
+	Payload      map[string]any // 事件负载，供守卫表达式使用
+	Path         string         // 请求路径
+	RequestData  string         // 请求数据
+	ResponseData string         // 响应数据
+	ResponseCode int            // 响应状态码
+	Attempts     []Attempt      // 请求尝试记录（含重试）
+	Vars         map[string]any // 本步需要合并进会话变量的值（如响应提取结果）
+	Error        string         // 本步的非致命错误，记录到会话历史
+}
+
+// NodeMeta 节点 Data 中与流程语义相关的字段
+type NodeMeta struct {
+	Category string `json:"nodeCategory"` // scene | choice | result | task
+	Kind     string `json:"nodeKind"`     // scene 节点：start | end | default
+	Executor string `json:"executor"`     // 可选：显式指定执行器名，默认按 nodeCategory 选择
+}
+
+// ParseNodeMeta 从 SMNode.Data（{ position, data }）中解析 nodeCategory/nodeKind
+func ParseNodeMeta(n orm.SMNode) NodeMeta {
+	var stored struct {
+		Data NodeMeta `json:"data"`
+	}
+	if n.Data != "" {
+		_ = json.Unmarshal([]byte(n.Data), &stored)
+	}
+	return stored.Data
+}
+
+// LoadSession 按主键加载会话
+func (e *Engine) LoadSession(tx *gorm.DB, id int64) (*orm.SessionInfo, error) {
+	var s orm.SessionInfo
+	if err := tx.First(&s, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// FindNode 查找流程中的节点
+func (e *Engine) FindNode(tx *gorm.DB, smID int64, nodeID string) (*orm.SMNode, error) {
+	var n orm.SMNode
+	if err := tx.Where("sm_id = ? AND node_id = ?", smID, nodeID).First(&n).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+	return &n, nil
+}
+
+// updateSession 以乐观锁更新会话：仅当数据库中的版本仍为 session.Version 时更新并将版本加一，
+// 否则说明会话在读取后已被其他请求修改，返回 ErrVersionConflict
+func updateSession(tx *gorm.DB, session *orm.SessionInfo, updates map[string]interface{}) error {
+	updates["version"] = gorm.Expr("version + 1")
+	result := tx.Model(session).Where("version = ?", session.Version).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: 会话已被其他请求修改", ErrVersionConflict)
+	}
+	session.Version++
+	return nil
+}
+
+// checkVersion 校验调用方期望的会话版本，expected 为 0 时不校验
+func checkVersion(session *orm.SessionInfo, expected int64) error {
+	if expected != 0 && session.Version != expected {
+		return fmt.Errorf("%w: 期望版本 %d，当前版本 %d", ErrVersionConflict, expected, session.Version)
+	}
+	return nil
+}
+
+// StartNode 查找流程的开始节点（nodeCategory=scene 且 nodeKind=start）
+func (e *Engine) StartNode(tx *gorm.DB, smID int64) (*orm.SMNode, error) {
+	var nodes []orm.SMNode
+	if err := tx.Where("sm_id = ?", smID).Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		meta := ParseNodeMeta(nodes[i])
+		if meta.Category == "scene" && meta.Kind == "start" {
+			return &nodes[i], nil
+		}
+	}
+	return nil, ErrNoStartNode
+}
+
+// Outgoing 返回从指定节点出发的边，按优先级从高到低排列
+func (e *Engine) Outgoing(tx *gorm.DB, smID int64, nodeID string) ([]orm.SMEdge, error) {
+	var edges []orm.SMEdge
+	err := tx.Where("sm_id = ? AND from_node_id = ?", smID, nodeID).Order("priority DESC, id").Find(&edges).Error
+	return edges, err
+}
+
+// Apply 在事务 tx 中执行一次迁移：校验出边、更新 SessionInfo.State 与会话变量（到达结束节点时标记为 ended），并记录 SessionDetail
+func (e *Engine) Apply(tx *gorm.DB, session *orm.SessionInfo, t Transition) (*orm.SessionDetail, error) {
+	target := t.Target
+	if !t.Force {
+		var err error
+		if target, err = e.selectTarget(tx, session, t.Event, t.Target, t.Payload); err != nil {
+			return nil, err
+		}
+	}
+	node, err := e.FindNode(tx, session.SMID, target)
+	if err != nil {
+		return nil, err
+	}
+	from := session.State
+	input := EncodeContext(DecodeContext(session.Context))
+	output := EncodeContext(MergePatch(DecodeContext(session.Context), t.Vars))
+	// 到达结束节点时会话结束；从结束节点离开（如设计页单步运行）时恢复运行
+	status := session.Status
+	if ParseNodeMeta(*node).Kind == "end" {
+		status = "ended"
+	} else if status == "ended" {
+		status = "running"
+	}
+	if err := updateSession(tx, session, map[string]interface{}{"state": target, "context": output, "status": status}); err != nil {
+		return nil, err
+	}
+	session.State = target
+	session.Context = output
+	session.Status = status
+	detail := &orm.SessionDetail{
+		SessionID:    session.ID,
+		NodeID:       target,
+		SMID:         session.SMID,
+		Event:        t.Event,
+		FromState:    from,
+		ToState:      target,
+		Path:         t.Path,
+		RequestData:  t.RequestData,
+		ResponseData: t.ResponseData,
+		ResponseCode: t.ResponseCode,
+		Error:        t.Error,
+		Attempts:     EncodeAttempts(t.Attempts),
+		Input:        input,
+		Output:       output,
+	}
+	if err := recordDetail(tx, detail); err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// recordDetail 追加一条会话历史，序号取会话内当前最大序号加一
+func recordDetail(tx *gorm.DB, detail *orm.SessionDetail) error {
+	var last int64
+	if err := tx.Unscoped().Model(&orm.SessionDetail{}).Where("session_id = ?", detail.SessionID).
+		Select("COALESCE(MAX(seq), 0)").Scan(&last).Error; err != nil {
+		return err
+	}
+	detail.Seq = last + 1
+	return tx.Create(detail).Error
+}
@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+// Event 投递到会话的命名事件
+type Event struct {
+	Name    string         // 事件名，如 approve
+	Target  string         // 可选：显式指定目标节点 id
+	Payload map[string]any // 事件负载
+
+	ExpectedVersion int64 // 可选：期望的会话版本，不一致时返回 ErrVersionConflict
+}
+
+// EventResult 事件处理结果
+type EventResult struct {
+	Session  *orm.SessionInfo
+	Detail   *orm.SessionDetail
+	Response *Response // 目标节点未发起请求时为 nil
+	Wait     bool      // 目标节点等待外部输入
+}
+
+// Fire 向会话投递事件：选出匹配的出边，执行目标节点的执行器，再迁移到目标节点；
+// 守卫表达式求值出错或上游请求最终失败时记录到会话历史；会话不在运行中（挂起或已结束）时拒绝事件。
+// 执行期间会话被其他请求修改时迁移失败并返回 ErrVersionConflict。
+// 事件在会话执行队列中处理，同一会话的事件、节点运行与生命周期操作按提交顺序依次执行
+func (e *Engine) Fire(ctx context.Context, sessionID int64, ev Event) (*EventResult, error) {
+	session, err := e.LoadSession(e.db, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var result *EventResult
+	if qerr := e.queue.Do(ctx, sessionKey(session.SMID, session.LogicalSessionID), func() {
+		result, err = e.fire(ctx, sessionID, ev)
+	}); qerr != nil {
+		return nil, qerr
+	}
+	return result, err
+}
+
+func (e *Engine) fire(ctx context.Context, sessionID int64, ev Event) (*EventResult, error) {
+	session, err := e.LoadSession(e.db, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(session, ev.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if session.Status != "running" {
+		return nil, fmt.Errorf("%w: 会话状态为 %s", ErrSessionNotRunning, session.Status)
+	}
+	target, err := e.selectTarget(e.db, session, ev.Name, ev.Target, ev.Payload)
+	if err != nil {
+		if errors.Is(err, ErrGuard) {
+			e.failNode(session, session.State, ev.Name, err)
+		}
+		return nil, err
+	}
+	node, err := e.FindNode(e.db, session.SMID, target)
+	if err != nil {
+		return nil, err
+	}
+	var flow orm.SMFlow
+	if err := e.db.First(&flow, session.SMID).Error; err != nil {
+		return nil, err
+	}
+	e.Notify(session, Notification{Type: NotifyNodeStarted, NodeID: target, Event: ev.Name})
+	exec, err := e.Execute(ctx, &ExecInput{Flow: &flow, Node: node, Session: session, Event: ev.Name, Payload: ev.Payload})
+	if err != nil {
+		e.failNode(session, target, ev.Name, err)
+		return nil, err
+	}
+
+	// 出边已在 selectTarget 中校验，事务内不再重复求值守卫
+	t := Transition{Event: ev.Name, Target: target, Force: true}
+	exec.fill(&t)
+	var detail *orm.SessionDetail
+	err = e.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		detail, err = e.Apply(tx, session, t)
+		return err
+	})
+	if err != nil {
+		e.failNode(session, target, ev.Name, err)
+		return nil, err
+	}
+	e.notifyApplied(session, detail)
+	return &EventResult{Session: session, Detail: detail, Response: exec.Response, Wait: exec.Wait}, nil
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/caoaolong/state-server/expr"
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+// ExecInput 节点执行器的输入
+type ExecInput struct {
+	Engine  *Engine
+	DB      *gorm.DB
+	Flow    *orm.SMFlow
+	Node    *orm.SMNode
+	Session *orm.SessionInfo
+	Event   string
+	Payload map[string]any
+}
+
+// Scope 返回本次执行的表达式求值环境
+func (in *ExecInput) Scope() map[string]any {
+	return in.Engine.Scope(in.DB, in.Session, in.Event, in.Payload)
+}
+
+// ExecResult 节点执行结果
+type ExecResult struct {
+	Request  *Request       // 发起了 HTTP 请求时非空
+	Response *Response      // 发起了 HTTP 请求时非空
+	Vars     map[string]any // 需要合并进会话变量的值
+	Wait     bool           // 节点需要等待外部输入（如选择节点）
+	Error    string         // 非致命错误，记录到会话历史
+}
+
+// Executor 节点执行器：按节点类别执行进入节点时的动作
+type Executor interface {
+	Execute(ctx context.Context, in *ExecInput) (*ExecResult, error)
+}
+
+// ExecutorFunc 函数形式的执行器
+type ExecutorFunc func(ctx context.Context, in *ExecInput) (*ExecResult, error)
+
+func (f ExecutorFunc) Execute(ctx context.Context, in *ExecInput) (*ExecResult, error) {
+	return f(ctx, in)
+}
+
+// executors 执行器注册表，键为执行器名或节点类别
+type executors struct {
+	mu sync.RWMutex
+	m  map[string]Executor
+}
+
+func newExecutors() *executors {
+	r := &executors{m: map[string]Executor{}}
+	r.m["http"] = ExecutorFunc(httpExecutor)
+	r.m["noop"] = ExecutorFunc(noopExecutor)
+	r.m["wait"] = ExecutorFunc(waitExecutor)
+	r.m["script"] = ExecutorFunc(scriptExecutor)
+	// 节点类别的默认执行器
+	r.m["task"] = r.m["http"]
+	r.m["scene"] = r.m["http"]
+	r.m["choice"] = r.m["wait"]
+	r.m["result"] = r.m["noop"]
+	return r
+}
+
+// RegisterExecutor 注册执行器；name 可以是节点类别（task/choice/result/scene），
+// 也可以是自定义名称，由节点 data.executor 显式引用。同名注册会覆盖已有执行器
+func (e *Engine) RegisterExecutor(name string, ex Executor) {
+	e.executors.mu.Lock()
+	defer e.executors.mu.Unlock()
+	e.executors.m[name] = ex
+}
+
+// executorFor 选择节点的执行器：优先 data.executor，其次 nodeCategory，都没有时按 http 处理
+func (e *Engine) executorFor(node *orm.SMNode) (Executor, error) {
+	meta := ParseNodeMeta(*node)
+	name := meta.Executor
+	if name == "" {
+		name = meta.Category
+	}
+	e.executors.mu.RLock()
+	defer e.executors.mu.RUnlock()
+	if ex, ok := e.executors.m[name]; ok {
+		return ex, nil
+	}
+	if meta.Executor != "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownExecutor, meta.Executor)
+	}
+	return e.executors.m["http"], nil
+}
+
+// Execute 按节点类别选择执行器并执行
+func (e *Engine) Execute(ctx context.Context, in *ExecInput) (*ExecResult, error) {
+	if in.Engine == nil {
+		in.Engine = e
+	}
+	if in.DB == nil {
+		in.DB = e.db
+	}
+	ex, err := e.executorFor(in.Node)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ex.Execute(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &ExecResult{}
+	}
+	return result, nil
+}
+
+// fill 将执行结果写入迁移描述
+func (r *ExecResult) fill(t *Transition) {
+	if r.Request != nil {
+		t.Path = r.Request.Path
+		t.RequestData = r.Request.Body
+	}
+	if r.Response != nil {
+		t.ResponseData = r.Response.Body
+		t.ResponseCode = r.Response.StatusCode
+		t.Attempts = r.Response.Attempts
+	}
+	t.Vars = r.Vars
+	t.Error = r.Error
+}
+
+// httpExecutor 渲染并发送节点请求，按提取规则取出会话变量；节点未配置请求路径时不做任何事
+func httpExecutor(ctx context.Context, in *ExecInput) (*ExecResult, error) {
+	if strings.TrimSpace(in.Node.RequestPath) == "" {
+		return &ExecResult{}, nil
+	}
+	req, err := in.Engine.NewRequest(in.DB, in.Flow, in.Session, in.Event, in.Payload, in.Node.RequestPath, in.Node.RequestMethod, in.Node.RequestData)
+	if err != nil {
+		return nil, err
+	}
+	req.Options = ResolveHTTPOptions(in.Flow, in.Node)
+	if err := in.Engine.Authorize(in.DB, req, in.Flow, in.Node, in.Scope()); err != nil {
+		return nil, err
+	}
+	resp, err := in.Engine.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	result := &ExecResult{Request: req, Response: resp}
+	if result.Vars, err = ExtractVars(in.Node, resp); err != nil {
+		result.Error = err.Error()
+	}
+	return result, nil
+}
+
+func noopExecutor(context.Context, *ExecInput) (*ExecResult, error) {
+	return &ExecResult{}, nil
+}
+
+// waitExecutor 不执行任何动作，标记会话等待外部事件（如用户在选择节点上做出选择）
+func waitExecutor(context.Context, *ExecInput) (*ExecResult, error) {
+	return &ExecResult{Wait: true}, nil
+}
+
+// ScriptStep 脚本节点的一条赋值：把表达式结果写入会话变量
+type ScriptStep struct {
+	Var  string `json:"var"`
+	Expr string `json:"expr"`
+}
+
+// scriptExecutor 依次求值节点 data.script 中的赋值，后一条可引用前一条写入的变量
+func scriptExecutor(_ context.Context, in *ExecInput) (*ExecResult, error) {
+	var stored struct {
+		Data struct {
+			Script []ScriptStep `json:"script"`
+		} `json:"data"`
+	}
+	if in.Node.Data != "" {
+		if err := json.Unmarshal([]byte(in.Node.Data), &stored); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrScript, err)
+		}
+	}
+	scope := in.Scope()
+	vars, _ := scope["vars"].(map[string]any)
+	result := &ExecResult{Vars: map[string]any{}}
+	for _, step := range stored.Data.Script {
+		if step.Var == "" {
+			continue
+		}
+		v, err := expr.Eval(step.Expr, scope)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrScript, step.Var, err)
+		}
+		setPath(result.Vars, step.Var, v)
+		setPath(vars, step.Var, v)
+	}
+	return result, nil
+}
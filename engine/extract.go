@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+// ExtractRule 响应提取规则：把响应中的某个值写入会话变量
+type ExtractRule struct {
+	Source  string `json:"source"`            // body | header | status
+	Path    string `json:"path,omitempty"`    // source=body 时的 JSONPath，如 $.data.items[0].id
+	Name    string `json:"name,omitempty"`    // source=header 时的响应头名
+	Var     string `json:"var"`               // 目标变量名，支持 a.b 写入嵌套对象；为 * 时把取到的 JSON 对象顶层字段合并进会话变量
+	Default any    `json:"default,omitempty"` // 取不到值时写入的默认值，为空则跳过
+}
+
+// MergeVar 提取规则的目标变量为该值时，取到的 JSON 对象顶层字段整体合并进会话变量，需显式配置
+const MergeVar = "*"
+
+// ParseExtractRules 解析 SMNode.Extract
+func ParseExtractRules(raw string) ([]ExtractRule, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var rules []ExtractRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("提取规则格式错误: %w", err)
+	}
+	return rules, nil
+}
+
+// ExtractVars 按节点的提取规则从响应中取出会话变量；只写入规则声明的变量，
+// 节点未配置规则时不提取。需要整体合并响应时配置 {"path":"$","var":"*"}，且只合并成功响应
+func ExtractVars(node *orm.SMNode, resp *Response) (map[string]any, error) {
+	if resp == nil {
+		return nil, nil
+	}
+	var rules []ExtractRule
+	if node != nil {
+		var err error
+		if rules, err = ParseExtractRules(node.Extract); err != nil {
+			return nil, err
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	body := parseBody(resp.Body)
+	vars := map[string]any{}
+	for _, rule := range rules {
+		if rule.Var == "" {
+			continue
+		}
+		var v any
+		switch rule.Source {
+		case "", "body":
+			v = JSONPath(body, rule.Path)
+		case "header":
+			if h := resp.Header.Get(rule.Name); h != "" {
+				v = h
+			}
+		case "status":
+			v = resp.StatusCode
+		default:
+			return nil, fmt.Errorf("未知的提取来源 %q", rule.Source)
+		}
+		if v == nil {
+			v = rule.Default
+		}
+		if rule.Var == MergeVar {
+			if obj, ok := v.(map[string]any); ok && resp.OK() {
+				for k, x := range obj {
+					vars[k] = x
+				}
+			}
+			continue
+		}
+		if v != nil {
+			setPath(vars, rule.Var, v)
+		}
+	}
+	return vars, nil
+}
+
+// setPath 按 a.b.c 写入嵌套对象
+func setPath(m map[string]any, path string, v any) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+// JSONPath 按简化的 JSONPath 取值：支持 $、.key、['key']、[index] 与 [*]，路径不存在时返回 nil
+func JSONPath(doc any, path string) any {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	if path == "" {
+		return doc
+	}
+	current := []any{doc}
+	wildcard := false
+	for path != "" {
+		var key string
+		switch {
+		case path[0] == '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			key, path = path[:end], path[end:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil
+			}
+			key, path = strings.Trim(path[1:end], `'"`), path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			key, path = path[:end], path[end:]
+		}
+		var next []any
+		for _, node := range current {
+			if key == "*" {
+				wildcard = true
+				switch x := node.(type) {
+				case []any:
+					next = append(next, x...)
+				case map[string]any:
+					for _, v := range x {
+						next = append(next, v)
+					}
+				}
+				continue
+			}
+			switch x := node.(type) {
+			case map[string]any:
+				if v, ok := x[key]; ok {
+					next = append(next, v)
+				}
+			case []any:
+				if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(x) {
+					next = append(next, x[i])
+				}
+			}
+		}
+		current = next
+	}
+	if wildcard {
+		if current == nil {
+			return []any{}
+		}
+		return current
+	}
+	if len(current) == 0 {
+		return nil
+	}
+	return current[0]
+}
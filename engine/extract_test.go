@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+func TestExtractVars(t *testing.T) {
+	ok := &Response{StatusCode: 200, Header: http.Header{"X-Request-Id": {"r1"}}, Body: `{"data":{"id":"ord-42"},"role":"admin"}`}
+	failed := &Response{StatusCode: 400, Body: `{"role":"admin"}`}
+	tests := []struct {
+		name    string
+		extract string
+		resp    *Response
+		want    map[string]any
+	}{
+		{"未配置规则不提取", "", ok, nil},
+		{"只写入声明的变量", `[{"source":"body","path":"$.data.id","var":"order.id"}]`, ok,
+			map[string]any{"order": map[string]any{"id": "ord-42"}}},
+		{"响应头与状态码", `[{"source":"header","name":"X-Request-Id","var":"rid"},{"source":"status","var":"code"}]`, ok,
+			map[string]any{"rid": "r1", "code": 200}},
+		{"取不到值时写入默认值", `[{"path":"$.missing","var":"m","default":"none"}]`, ok,
+			map[string]any{"m": "none"}},
+		{"显式合并整个响应", `[{"path":"$","var":"*"}]`, ok,
+			map[string]any{"data": map[string]any{"id": "ord-42"}, "role": "admin"}},
+		{"失败响应不合并", `[{"path":"$","var":"*"}]`, failed, map[string]any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractVars(&orm.SMNode{Extract: tt.extract}, tt.resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
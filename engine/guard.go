@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caoaolong/state-server/expr"
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrGuard         = errors.New("守卫表达式求值失败")
+	ErrGuardRejected = errors.New("没有满足守卫条件的出边")
+)
+
+// Scope 构建守卫表达式与请求模板的求值环境：
+// session（id/logicalId/state/status/vars）、vars（会话变量）、event（name/payload）、payload、
+// flow（id/name/identifier/baseUrl/constants）、const（流程常量）、
+// response（当前节点上一次请求的 status 与 body，body 为 JSON 时解析为对象）
+func (e *Engine) Scope(tx *gorm.DB, session *orm.SessionInfo, event string, payload map[string]any) map[string]any {
+	if payload == nil {
+		payload = map[string]any{}
+	}
+	response := map[string]any{"status": 0, "body": nil}
+	if session.State != "" {
+		var last orm.SessionDetail
+		err := tx.Where("session_id = ? AND node_id = ? AND response_code <> 0", session.ID, session.State).Order("seq DESC").First(&last).Error
+		if err == nil {
+			response["status"] = last.ResponseCode
+			response["body"] = parseBody(last.ResponseData)
+		}
+	}
+	flowScope := map[string]any{"id": session.SMID, "constants": map[string]any{}}
+	var flow orm.SMFlow
+	if err := tx.First(&flow, session.SMID).Error; err == nil {
+		flowScope["name"] = flow.Name
+		flowScope["identifier"] = flow.Identifier
+		flowScope["baseUrl"] = flow.BaseURL
+		flowScope["constants"] = DecodeConstants(&flow)
+	}
+	vars := DecodeContext(session.Context)
+	return map[string]any{
+		"flow":  flowScope,
+		"const": flowScope["constants"],
+		"session": map[string]any{
+			"id":        session.ID,
+			"logicalId": session.LogicalSessionID,
+			"state":     session.State,
+			"status":    session.Status,
+			"vars":      vars,
+		},
+		"vars":     vars,
+		"event":    map[string]any{"name": event, "payload": payload},
+		"payload":  payload,
+		"response": response,
+	}
+}
+
+// parseBody 响应体为 JSON 时解析，否则原样返回字符串
+func parseBody(body string) any {
+	if strings.TrimSpace(body) == "" {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return body
+	}
+	return v
+}
+
+// selectTarget 校验迁移并返回目标节点 id。
+// 会话尚未开始（State 为空）时只能进入开始节点；否则从当前节点的出边中挑选候选：
+// 指定目标时取指向目标的边，否则依次按边事件名、边 label、边 id、目标节点 id、目标节点 label 匹配事件名，
+// 都不匹配时取未声明事件的出边。候选中先按优先级检查带守卫的边，再取无守卫的边作为默认分支；
+// 守卫求值出错时直接返回 ErrGuard，不再尝试其他边
+func (e *Engine) selectTarget(tx *gorm.DB, session *orm.SessionInfo, event, target string, payload map[string]any) (string, error) {
+	if session.State == "" {
+		start, err := e.StartNode(tx, session.SMID)
+		if err != nil {
+			return "", err
+		}
+		if target != "" && target != start.NodeID {
+			return "", ErrInvalidTarget
+		}
+		return start.NodeID, nil
+	}
+	edges, err := e.Outgoing(tx, session.SMID, session.State)
+	if err != nil {
+		return "", err
+	}
+	if len(edges) == 0 {
+		return "", ErrNoTransition
+	}
+	var candidates []orm.SMEdge
+	if target != "" {
+		candidates = filterEdges(edges, func(edge orm.SMEdge) bool { return edge.ToNodeID == target })
+		if len(candidates) == 0 {
+			return "", ErrInvalidTarget
+		}
+	} else {
+		candidates = e.matchEvent(tx, session.SMID, edges, event)
+		if len(candidates) == 0 {
+			return "", ErrNoTransition
+		}
+	}
+
+	guarded := filterEdges(candidates, func(edge orm.SMEdge) bool { return edge.Guard != "" })
+	unguarded := filterEdges(candidates, func(edge orm.SMEdge) bool { return edge.Guard == "" })
+	if len(guarded) > 0 {
+		scope := e.Scope(tx, session, event, payload)
+		for _, edge := range guarded {
+			ok, err := expr.EvalBool(edge.Guard, scope)
+			if err != nil {
+				return "", fmt.Errorf("%w: 边 %s: %v", ErrGuard, edge.EdgeID, err)
+			}
+			if ok {
+				return edge.ToNodeID, nil
+			}
+		}
+	}
+	switch {
+	case len(unguarded) == 1:
+		return unguarded[0].ToNodeID, nil
+	case len(unguarded) > 1:
+		if target != "" {
+			return target, nil
+		}
+		return "", ErrAmbiguous
+	}
+	return "", ErrGuardRejected
+}
+
+// matchEvent 按事件名从出边中挑选候选边
+func (e *Engine) matchEvent(tx *gorm.DB, smID int64, edges []orm.SMEdge, event string) []orm.SMEdge {
+	matchers := []func(orm.SMEdge) bool{
+		func(edge orm.SMEdge) bool { return edge.Event != "" && edge.Event == event },
+		func(edge orm.SMEdge) bool { return edge.Label != "" && strings.EqualFold(edge.Label, event) },
+		func(edge orm.SMEdge) bool { return edge.EdgeID == event || edge.ToNodeID == event },
+		func(edge orm.SMEdge) bool {
+			node, err := e.FindNode(tx, smID, edge.ToNodeID)
+			return err == nil && node.Label != "" && strings.EqualFold(node.Label, event)
+		},
+		func(edge orm.SMEdge) bool { return edge.Event == "" },
+	}
+	for _, match := range matchers {
+		if candidates := filterEdges(edges, match); len(candidates) > 0 {
+			return candidates
+		}
+	}
+	return nil
+}
+
+func filterEdges(edges []orm.SMEdge, keep func(orm.SMEdge) bool) []orm.SMEdge {
+	var out []orm.SMEdge
+	for _, edge := range edges {
+		if keep(edge) {
+			out = append(out, edge)
+		}
+	}
+	return out
+}
+
+// RecordFailure 将迁移失败原因追加到会话历史（节点为当前节点），便于排查守卫表达式、上游请求等错误，返回写入的记录
+func (e *Engine) RecordFailure(session *orm.SessionInfo, event string, cause error) (*orm.SessionDetail, error) {
+	detail := &orm.SessionDetail{
+		SessionID: session.ID,
+		NodeID:    session.State,
+		SMID:      session.SMID,
+		Event:     event,
+		FromState: session.State,
+		ToState:   session.State,
+		Error:     cause.Error(),
+	}
+	var reqErr *RequestError
+	if errors.As(cause, &reqErr) {
+		detail.Attempts = EncodeAttempts(reqErr.Attempts)
+		if reqErr.Response != nil {
+			detail.ResponseCode, detail.ResponseData = reqErr.Response.StatusCode, reqErr.Response.Body
+		}
+	}
+	if err := e.db.Transaction(func(tx *gorm.DB) error {
+		return recordDetail(tx, detail)
+	}); err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// failNode 节点执行失败：守卫表达式出错与上游请求失败记录到会话历史，
+// 并推送 node.failed 通知（记录成功时带上 DetailID，订阅者可实时拿到该条历史）
+func (e *Engine) failNode(session *orm.SessionInfo, nodeID, event string, cause error) {
+	n := Notification{Type: NotifyNodeFailed, NodeID: nodeID, Event: event, Error: cause.Error()}
+	if errors.Is(cause, ErrGuard) || errors.Is(cause, ErrRequestFailed) {
+		if detail, err := e.RecordFailure(session, event, cause); err == nil {
+			n.DetailID = detail.ID
+		}
+	}
+	e.Notify(session, n)
+}
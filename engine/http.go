@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+var (
+	ErrNoBaseURL     = errors.New("请先配置状态机的 Base URL")
+	ErrRequestFailed = errors.New("请求失败")
+)
+
+// Request 节点出站 HTTP 请求
+type Request struct {
+	Method  string
+	URL     string
+	Path    string // 不含 base_url 的请求路径，用于记录历史
+	Body    string
+	Header  http.Header // 自定义请求头（含认证头），不记录到会话历史
+	Signer  *HMACSigner // 非空时每次发送前对请求签名
+	Options HTTPOptions
+}
+
+// Response 节点出站 HTTP 响应
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+	Attempts   []Attempt // 每次尝试的记录（含重试）
+}
+
+// OK 状态码是否为 2xx
+func (r *Response) OK() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// BuildRequest 将流程 base_url 与节点请求路径拼接成出站请求，方法默认 GET
+func BuildRequest(flow *orm.SMFlow, path, method, data string) (*Request, error) {
+	baseURL := strings.TrimSuffix(strings.TrimSpace(flow.BaseURL), "/")
+	if baseURL == "" {
+		return nil, ErrNoBaseURL
+	}
+	path = strings.TrimSpace(path)
+	if path != "" && path[0] != '/' {
+		path = "/" + path
+	}
+	method = strings.TrimSpace(strings.ToUpper(method))
+	if method == "" {
+		method = "GET"
+	}
+	return &Request{Method: method, URL: baseURL + path, Path: path, Body: data}, nil
+}
+
+// Do 发送请求并读取完整响应体；按 req.Options 设置超时、TLS 与代理，
+// 遇到网络错误或 5xx 时按指数退避重试，每次尝试记录在 Response.Attempts 中。
+// 重试用尽后仍为网络错误或 5xx 时返回 RequestError（ErrRequestFailed），调用方不应按成功迁移会话
+func (e *Engine) Do(ctx context.Context, req *Request) (*Response, error) {
+	transport, err := e.transports.get(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: transport, Timeout: req.Options.timeout()}
+	retries := req.Options.retries()
+	var attempts []Attempt
+	for i := 0; ; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, &RequestError{Attempts: attempts, Err: ctx.Err()}
+			case <-time.After(req.Options.backoff(i)):
+			}
+		}
+		start := time.Now()
+		resp, err := e.doOnce(ctx, client, req)
+		attempt := Attempt{Attempt: i + 1, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			attempt.Error = err.Error()
+			attempts = append(attempts, attempt)
+			if i < retries && ctx.Err() == nil {
+				continue
+			}
+			return nil, &RequestError{Attempts: attempts, Err: err}
+		}
+		attempt.StatusCode = resp.StatusCode
+		attempts = append(attempts, attempt)
+		resp.Attempts = attempts
+		if resp.StatusCode >= 500 {
+			if i < retries && ctx.Err() == nil {
+				continue
+			}
+			return nil, &RequestError{Attempts: attempts, Response: resp, Err: fmt.Errorf("上游返回 %d", resp.StatusCode)}
+		}
+		return resp, nil
+	}
+}
+
+func (e *Engine) doOnce(ctx context.Context, client *http.Client, req *Request) (*Response, error) {
+	var body io.Reader
+	if req.Method != "GET" && req.Body != "" {
+		body = bytes.NewBufferString(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		httpReq.Header[k] = v
+	}
+	if body != nil && httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if req.Signer != nil {
+		signed := ""
+		if body != nil {
+			signed = req.Body
+		}
+		req.Signer.Sign(httpReq, signed, time.Now())
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(respBody)}, nil
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionNotRunning = errors.New("会话未在运行中")
+	ErrLifecycle         = errors.New("会话当前状态不允许该操作")
+)
+
+// 会话生命周期操作
+const (
+	LifecycleSuspend = "suspend" // 挂起运行中的会话，挂起期间拒绝事件
+	LifecycleResume  = "resume"  // 恢复挂起的会话
+	LifecycleEnd     = "end"     // 结束未结束的会话
+	LifecycleRestart = "restart" // 回到初始状态：回到开始节点并清空会话变量，重新运行
+)
+
+// lifecycleRules 各操作允许的当前状态、操作后的状态与发布的通知
+var lifecycleRules = map[string]struct {
+	from   []string
+	to     string
+	notify string
+}{
+	LifecycleSuspend: {[]string{"running"}, "suspended", NotifySessionSuspended},
+	LifecycleResume:  {[]string{"suspended"}, "running", NotifySessionResumed},
+	LifecycleEnd:     {[]string{"running", "suspended"}, "ended", NotifySessionEnded},
+	LifecycleRestart: {[]string{"running", "suspended", "ended"}, "running", NotifySessionRestarted},
+}
+
+// Lifecycle 在事务中执行生命周期操作，更新 SessionInfo.Status 并记录到会话历史（事件名为操作名）；
+// expectedVersion 不为 0 时校验会话版本。与 Fire 共用会话执行队列，不会插入到正在处理的事件中间
+func (e *Engine) Lifecycle(ctx context.Context, sessionID int64, op string, expectedVersion int64) (*orm.SessionInfo, *orm.SessionDetail, error) {
+	s, err := e.LoadSession(e.db, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var session *orm.SessionInfo
+	var detail *orm.SessionDetail
+	if qerr := e.queue.Do(ctx, sessionKey(s.SMID, s.LogicalSessionID), func() {
+		session, detail, err = e.lifecycle(sessionID, op, expectedVersion)
+	}); qerr != nil {
+		return nil, nil, qerr
+	}
+	return session, detail, err
+}
+
+func (e *Engine) lifecycle(sessionID int64, op string, expectedVersion int64) (*orm.SessionInfo, *orm.SessionDetail, error) {
+	rule, ok := lifecycleRules[op]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: 未知的操作 %q", ErrLifecycle, op)
+	}
+	var session *orm.SessionInfo
+	var detail *orm.SessionDetail
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if session, err = e.LoadSession(tx, sessionID); err != nil {
+			return err
+		}
+		if err := checkVersion(session, expectedVersion); err != nil {
+			return err
+		}
+		allowed := false
+		for _, s := range rule.from {
+			allowed = allowed || session.Status == s
+		}
+		if !allowed {
+			return fmt.Errorf("%w: 会话状态为 %s，不能执行 %s", ErrLifecycle, session.Status, op)
+		}
+		from := session.State
+		input := EncodeContext(DecodeContext(session.Context))
+		updates := map[string]interface{}{"status": rule.to}
+		state := session.State
+		if op == LifecycleRestart {
+			// 与新建会话一致放到开始节点；流程暂无开始节点时回到未开始状态
+			state = ""
+			if start, err := e.StartNode(tx, session.SMID); err == nil {
+				state = start.NodeID
+			} else if !errors.Is(err, ErrNoStartNode) {
+				return err
+			}
+			updates["state"], updates["context"] = state, "{}"
+		}
+		if err := updateSession(tx, session, updates); err != nil {
+			return err
+		}
+		session.Status = rule.to
+		if op == LifecycleRestart {
+			session.State, session.Context = state, "{}"
+		}
+		detail = &orm.SessionDetail{
+			SessionID: session.ID,
+			NodeID:    session.State,
+			SMID:      session.SMID,
+			Event:     op,
+			FromState: from,
+			ToState:   session.State,
+			Input:     input,
+			Output:    EncodeContext(DecodeContext(session.Context)),
+		}
+		return recordDetail(tx, detail)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	e.Notify(session, Notification{Type: rule.notify, NodeID: detail.NodeID, Event: op, FromState: detail.FromState, State: session.State, DetailID: detail.ID})
+	return session, detail, nil
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLifecycle(t *testing.T) {
+	e, s := newTestEngine(t)
+	ctx := context.Background()
+
+	suspended, _, err := e.Lifecycle(ctx, s.ID, LifecycleSuspend, 0)
+	if err != nil || suspended.Status != "suspended" {
+		t.Fatalf("挂起: status=%v err=%v", suspended, err)
+	}
+	if _, err := e.Fire(ctx, s.ID, Event{Name: "go"}); !errors.Is(err, ErrSessionNotRunning) {
+		t.Fatalf("挂起的会话触发事件: got %v, want ErrSessionNotRunning", err)
+	}
+	if _, _, err := e.Lifecycle(ctx, s.ID, LifecycleSuspend, 0); !errors.Is(err, ErrLifecycle) {
+		t.Fatalf("重复挂起: got %v, want ErrLifecycle", err)
+	}
+	if _, _, err := e.Lifecycle(ctx, s.ID, LifecycleResume, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Fire(ctx, s.ID, Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.PatchContext(ctx, s.ID, map[string]any{"x": 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ended, _, err := e.Lifecycle(ctx, s.ID, LifecycleEnd, 0)
+	if err != nil || ended.Status != "ended" {
+		t.Fatalf("结束: session=%v err=%v", ended, err)
+	}
+	if _, _, err := e.Lifecycle(ctx, s.ID, LifecycleResume, 0); !errors.Is(err, ErrLifecycle) {
+		t.Fatalf("恢复已结束的会话: got %v, want ErrLifecycle", err)
+	}
+
+	restarted, detail, err := e.Lifecycle(ctx, s.ID, LifecycleRestart, ended.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Status != "running" || restarted.State != "s" || restarted.Context != "{}" {
+		t.Fatalf("重启后应回到开始节点并清空变量: %+v", restarted)
+	}
+	if detail == nil || detail.Event != LifecycleRestart {
+		t.Fatalf("重启应记录到会话历史: %+v", detail)
+	}
+	if _, _, err := e.Lifecycle(ctx, s.ID, "pause", 0); !errors.Is(err, ErrLifecycle) {
+		t.Fatalf("未知操作: got %v, want ErrLifecycle", err)
+	}
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+// 通知类型
+const (
+	NotifySessionCreated   = "session.created"   // 创建会话
+	NotifyNodeStarted      = "node.started"      // 开始执行节点
+	NotifyNodeFinished     = "node.finished"     // 节点执行完成并写入会话历史
+	NotifyNodeFailed       = "node.failed"       // 节点执行失败，会话状态不变
+	NotifyStateChanged     = "state.changed"     // 会话迁移到新状态
+	NotifySessionEnded     = "session.ended"     // 会话到达结束节点或被手动结束
+	NotifySessionSuspended = "session.suspended" // 会话被挂起
+	NotifySessionResumed   = "session.resumed"   // 挂起的会话被恢复
+	NotifySessionRestarted = "session.restarted" // 会话回到初始状态重新运行
+)
+
+// Notification 会话运行过程中推送给订阅者的通知
+type Notification struct {
+	Type       string    `json:"type"`
+	SessionID  int64     `json:"sessionId,string"` // SessionInfo.ID
+	LogicalID  int64     `json:"logicalSessionId,string"`
+	FlowID     int64     `json:"flowId,string"`
+	NodeID     string    `json:"nodeId,omitempty"`
+	Event      string    `json:"event,omitempty"`
+	FromState  string    `json:"fromState,omitempty"`
+	State      string    `json:"state,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Version    int64     `json:"version,omitempty"`         // 通知发出时的会话版本
+	DetailID   int64     `json:"detailId,string,omitempty"` // 对应的 SessionDetail.ID
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Bus 进程内通知总线：发布不阻塞，订阅者消费过慢时丢弃其新通知（或按订阅方式关闭其通道）
+type Bus struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]*subscription
+}
+
+type subscription struct {
+	filter          func(Notification) bool
+	ch              chan Notification
+	closeOnOverflow bool   // 通道已满时取消订阅并关闭通道，而不是静默丢弃
+	cancel          func() // 取消订阅并关闭通道，可重复调用
+}
+
+func newBus() *Bus {
+	return &Bus{subs: map[int]*subscription{}}
+}
+
+// Subscribe 订阅通知：filter 为 nil 时接收全部通知，buffer 为通道容量，通道已满时丢弃新通知。
+// 返回的 cancel 取消订阅并关闭通道，可重复调用
+func (b *Bus) Subscribe(buffer int, filter func(Notification) bool) (<-chan Notification, func()) {
+	return b.subscribe(buffer, filter, false)
+}
+
+// SubscribeOrClose 与 Subscribe 相同，但通道已满、通知无法送达时取消订阅并关闭通道，
+// 订阅者据此得知通知出现缺失，可以重新同步（如 SSE 客户端凭 Last-Event-ID 重连补齐）
+func (b *Bus) SubscribeOrClose(buffer int, filter func(Notification) bool) (<-chan Notification, func()) {
+	return b.subscribe(buffer, filter, true)
+}
+
+func (b *Bus) subscribe(buffer int, filter func(Notification) bool, closeOnOverflow bool) (<-chan Notification, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	sub := &subscription{filter: filter, ch: make(chan Notification, buffer), closeOnOverflow: closeOnOverflow}
+	var once sync.Once
+	sub.cancel = func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+	b.subs[id] = sub
+	return sub.ch, sub.cancel
+}
+
+// Publish 向所有匹配的订阅者发送通知
+func (b *Bus) Publish(n Notification) {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	var overflowed []*subscription
+	b.mu.RLock()
+	for _, sub := range b.subs {
+		if sub.filter != nil && !sub.filter(n) {
+			continue
+		}
+		select {
+		case sub.ch <- n:
+		default:
+			if sub.closeOnOverflow {
+				overflowed = append(overflowed, sub)
+			}
+		}
+	}
+	b.mu.RUnlock()
+	// 释放读锁后再取消订阅：cancel 需要写锁，且须在不再有发布者向通道发送后才能关闭通道
+	for _, sub := range overflowed {
+		sub.cancel()
+	}
+}
+
+// Bus 返回引擎的通知总线
+func (e *Engine) Bus() *Bus {
+	return e.bus
+}
+
+// Notify 以会话信息填充通知并发布，同时生成订阅了该事件的 Webhook 投递记录；
+// 须在会话变更提交之后调用，引擎之外的会话操作（如创建会话）也通过它发布通知
+func (e *Engine) Notify(session *orm.SessionInfo, n Notification) {
+	n.SessionID = session.ID
+	n.LogicalID = session.LogicalSessionID
+	n.FlowID = session.SMID
+	n.Version = session.Version
+	if n.Status == "" {
+		n.Status = session.Status
+	}
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	e.bus.Publish(n)
+	e.notifyWebhooks(n)
+}
+
+// notifyApplied 发布一次迁移完成后的通知：节点完成、状态变化，到达结束节点时发布会话结束
+func (e *Engine) notifyApplied(session *orm.SessionInfo, detail *orm.SessionDetail) {
+	e.Notify(session, Notification{
+		Type:       NotifyNodeFinished,
+		NodeID:     detail.NodeID,
+		Event:      detail.Event,
+		DetailID:   detail.ID,
+		StatusCode: detail.ResponseCode,
+		Error:      detail.Error,
+	})
+	e.Notify(session, Notification{
+		Type:      NotifyStateChanged,
+		NodeID:    detail.NodeID,
+		Event:     detail.Event,
+		FromState: detail.FromState,
+		State:     session.State,
+		DetailID:  detail.ID,
+	})
+	if session.Status == "ended" {
+		e.Notify(session, Notification{Type: NotifySessionEnded, NodeID: detail.NodeID, State: session.State})
+	}
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBusSubscribeDropsWhenFull(t *testing.T) {
+	bus := newBus()
+	ch, cancel := bus.Subscribe(1, nil)
+	defer cancel()
+	bus.Publish(Notification{Type: NotifyNodeStarted})
+	bus.Publish(Notification{Type: NotifyNodeFinished})
+
+	if n := <-ch; n.Type != NotifyNodeStarted {
+		t.Fatalf("got %s, want %s", n.Type, NotifyNodeStarted)
+	}
+	bus.Publish(Notification{Type: NotifyStateChanged})
+	if n, ok := <-ch; !ok || n.Type != NotifyStateChanged {
+		t.Fatalf("got %s (open=%v), want %s", n.Type, ok, NotifyStateChanged)
+	}
+}
+
+func TestBusSubscribeOrCloseClosesOnOverflow(t *testing.T) {
+	bus := newBus()
+	ch, cancel := bus.SubscribeOrClose(1, nil)
+	defer cancel()
+	bus.Publish(Notification{Type: NotifyNodeStarted})
+	bus.Publish(Notification{Type: NotifyNodeFinished})
+
+	if n, ok := <-ch; !ok || n.Type != NotifyNodeStarted {
+		t.Fatalf("got %s (open=%v), want %s", n.Type, ok, NotifyNodeStarted)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("溢出后通道应当关闭")
+	}
+	// 已取消的订阅不再接收，重复 cancel 不会 panic
+	bus.Publish(Notification{Type: NotifyStateChanged})
+	cancel()
+}
+
+func TestBusConcurrentOverflow(t *testing.T) {
+	bus := newBus()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		_, cancel := bus.SubscribeOrClose(1, nil)
+		defer cancel()
+	}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				bus.Publish(Notification{Type: NotifyNodeStarted})
+			}
+		}()
+	}
+	wg.Wait()
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	if len(bus.subs) != 0 {
+		t.Fatalf("溢出的订阅应全部取消，剩余 %d 个", len(bus.subs))
+	}
+}
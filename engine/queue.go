@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrQueueFull 会话所在的执行队列已满，调用方应稍后重试
+var ErrQueueFull = errors.New("会话执行队列已满，请稍后重试")
+
+// QueueConfig 会话执行队列配置
+type QueueConfig struct {
+	Workers    int // 最多同时执行的任务数
+	QueueSize  int // 每个会话最多排队的任务数，超出时拒绝该会话的新任务
+	MaxPending int // 全部会话合计最多排队的任务数，超出时拒绝新任务
+}
+
+// LoadQueueConfig 从环境变量读取执行队列配置：SM_WORKERS 为并发执行数（默认 32），
+// SM_QUEUE_SIZE 为每个会话的队列长度（默认 64），SM_QUEUE_TOTAL 为全部会话的排队上限（默认 4096）
+func LoadQueueConfig() QueueConfig {
+	cfg := QueueConfig{Workers: 32, QueueSize: 64, MaxPending: 4096}
+	if n, err := strconv.Atoi(os.Getenv("SM_WORKERS")); err == nil && n > 0 {
+		cfg.Workers = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("SM_QUEUE_SIZE")); err == nil && n > 0 {
+		cfg.QueueSize = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("SM_QUEUE_TOTAL")); err == nil && n > 0 {
+		cfg.MaxPending = n
+	}
+	return cfg
+}
+
+// Queue 按键排队的执行队列：每个键有自己的先进先出队列，同一个键的任务按提交顺序串行执行；
+// 不同键的任务由最多 Workers 个并发名额并行执行，一个键的慢任务不会阻塞其他键。
+// 引擎以会话为键，保证同一会话的事件、节点运行与生命周期操作严格按序处理
+type Queue struct {
+	cfg       QueueConfig
+	sem       chan struct{} // 执行名额
+	mu        sync.Mutex
+	keys      map[string]*keyQueue // 有任务排队或执行中的键
+	pending   int                  // 全部键排队中（尚未开始执行）的任务数
+	running   atomic.Int64
+	processed atomic.Uint64
+	rejected  atomic.Uint64
+	canceled  atomic.Uint64
+}
+
+// keyQueue 一个键的待执行任务；存在于 Queue.keys 中时有且仅有一个 drain 协程在处理它
+type keyQueue struct {
+	key   string
+	tasks []*queueTask
+}
+
+type queueTask struct {
+	ctx  context.Context
+	fn   func()
+	done chan struct{}
+}
+
+// NewQueue 创建执行队列
+func NewQueue(cfg QueueConfig) *Queue {
+	return &Queue{cfg: cfg, sem: make(chan struct{}, cfg.Workers), keys: map[string]*keyQueue{}}
+}
+
+// Do 将 fn 放入 key 的队列并等待执行完成。该键或全部排队任务已达上限时立即返回 ErrQueueFull；
+// 等待期间 ctx 结束时返回 ctx.Err()，尚未开始的 fn 不再执行，已开始执行的 fn 仍会执行完毕
+func (q *Queue) Do(ctx context.Context, key string, fn func()) error {
+	t := &queueTask{ctx: ctx, fn: fn, done: make(chan struct{})}
+	q.mu.Lock()
+	kq := q.keys[key]
+	if q.pending >= q.cfg.MaxPending || (kq != nil && len(kq.tasks) >= q.cfg.QueueSize) {
+		q.mu.Unlock()
+		q.rejected.Add(1)
+		return ErrQueueFull
+	}
+	q.pending++
+	if kq == nil {
+		kq = &keyQueue{key: key}
+		q.keys[key] = kq
+		go q.drain(kq)
+	}
+	kq.tasks = append(kq.tasks, t)
+	q.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain 依次执行一个键的任务，每个任务执行前占用一个执行名额、执行后归还，队列清空后退出
+func (q *Queue) drain(kq *keyQueue) {
+	for {
+		q.sem <- struct{}{}
+		q.mu.Lock()
+		if len(kq.tasks) == 0 {
+			delete(q.keys, kq.key)
+			q.mu.Unlock()
+			<-q.sem
+			return
+		}
+		t := kq.tasks[0]
+		kq.tasks[0] = nil
+		kq.tasks = kq.tasks[1:]
+		q.pending--
+		q.mu.Unlock()
+
+		// 排队期间调用方已放弃（如客户端断开）的任务不再执行
+		if t.ctx.Err() != nil {
+			q.canceled.Add(1)
+		} else {
+			q.running.Add(1)
+			t.fn()
+			q.running.Add(-1)
+			q.processed.Add(1)
+		}
+		<-q.sem
+		close(t.done)
+	}
+}
+
+// QueueStats 执行队列的运行指标
+type QueueStats struct {
+	Workers    int    `json:"workers"`
+	QueueSize  int    `json:"queueSize"`  // 每个会话的队列长度
+	MaxPending int    `json:"maxPending"` // 全部会话的排队上限
+	Running    int64  `json:"running"`    // 正在执行的任务数
+	Depth      int    `json:"depth"`      // 全部会话排队中的任务数
+	MaxDepth   int    `json:"maxDepth"`   // 排队最多的会话的任务数
+	Sessions   int    `json:"sessions"`   // 有任务排队或执行中的会话数
+	Processed  uint64 `json:"processed"`  // 已执行的任务数
+	Rejected   uint64 `json:"rejected"`   // 因队列已满被拒绝的任务数
+	Canceled   uint64 `json:"canceled"`   // 排队期间被调用方放弃的任务数
+}
+
+// Stats 返回队列深度等运行指标
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	s := QueueStats{
+		Workers:    q.cfg.Workers,
+		QueueSize:  q.cfg.QueueSize,
+		MaxPending: q.cfg.MaxPending,
+		Depth:      q.pending,
+		Sessions:   len(q.keys),
+	}
+	for _, kq := range q.keys {
+		s.MaxDepth = max(s.MaxDepth, len(kq.tasks))
+	}
+	q.mu.Unlock()
+	s.Running = q.running.Load()
+	s.Processed = q.processed.Load()
+	s.Rejected = q.rejected.Load()
+	s.Canceled = q.canceled.Load()
+	return s
+}
+
+// sessionKey 会话在执行队列中的键：以状态机与逻辑会话 id 标识，运行节点时会话可能尚未创建
+func sessionKey(smID, logicalID int64) string {
+	return strconv.FormatInt(smID, 10) + ":" + strconv.FormatInt(logicalID, 10)
+}
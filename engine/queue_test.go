@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor 轮询直到 cond 成立，超时则失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueFIFOPerKey(t *testing.T) {
+	q := NewQueue(QueueConfig{Workers: 4, QueueSize: 100, MaxPending: 100})
+	ctx := context.Background()
+	gate := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.Do(ctx, "k", func() { <-gate })
+	}()
+	waitFor(t, "首个任务开始执行", func() bool { return q.Stats().Running == 1 })
+
+	var mu sync.Mutex
+	var order []int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.Do(ctx, "k", func() {
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+			}); err != nil {
+				t.Error(err)
+			}
+		}()
+		// 逐个确认入队，保证提交顺序确定
+		waitFor(t, "任务入队", func() bool { return q.Stats().Depth == i+1 })
+	}
+
+	// 同一个键阻塞时，其他键的任务不受影响
+	if err := q.Do(ctx, "other", func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(gate)
+	wg.Wait()
+	if len(order) != 20 {
+		t.Fatalf("执行了 %d 个任务，want 20", len(order))
+	}
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("执行顺序 %v 不是提交顺序", order)
+		}
+	}
+	if s := q.Stats(); s.Sessions != 0 || s.Depth != 0 {
+		t.Fatalf("队列清空后应无残留: %+v", s)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewQueue(QueueConfig{Workers: 1, QueueSize: 2, MaxPending: 3})
+	ctx := context.Background()
+	gate := make(chan struct{})
+	var wg sync.WaitGroup
+	submit := func(key string, depth int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.Do(ctx, key, func() { <-gate }); err != nil {
+				t.Error(err)
+			}
+		}()
+		waitFor(t, "任务入队", func() bool { return q.Stats().Depth == depth })
+	}
+	submit("a", 0) // 占用唯一的执行名额
+	waitFor(t, "首个任务开始执行", func() bool { return q.Stats().Running == 1 })
+	submit("a", 1)
+	submit("a", 2)
+
+	if err := q.Do(ctx, "a", func() { t.Error("被拒绝的任务不应执行") }); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("单个键超出 QueueSize: got %v, want ErrQueueFull", err)
+	}
+	submit("b", 3)
+	if err := q.Do(ctx, "c", func() { t.Error("被拒绝的任务不应执行") }); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("全部排队超出 MaxPending: got %v, want ErrQueueFull", err)
+	}
+
+	close(gate)
+	wg.Wait()
+	if s := q.Stats(); s.Rejected != 2 || s.Processed != 4 {
+		t.Fatalf("rejected=%d processed=%d, want 2 和 4", s.Rejected, s.Processed)
+	}
+}
+
+func TestQueueCanceledWhileQueued(t *testing.T) {
+	q := NewQueue(QueueConfig{Workers: 1, QueueSize: 10, MaxPending: 10})
+	gate := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		q.Do(context.Background(), "k", func() { <-gate })
+		close(done)
+	}()
+	waitFor(t, "首个任务开始执行", func() bool { return q.Stats().Running == 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- q.Do(ctx, "k", func() { t.Error("已放弃的任务不应执行") })
+	}()
+	waitFor(t, "任务入队", func() bool { return q.Stats().Depth == 1 })
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	close(gate)
+	<-done
+	waitFor(t, "队列清空", func() bool { return q.Stats().Sessions == 0 })
+	if c := q.Stats().Canceled; c != 1 {
+		t.Fatalf("canceled=%d, want 1", c)
+	}
+}
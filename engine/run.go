@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+var ErrFlowNotFound = errors.New("所属状态机不存在")
+
+// NodeRequest 节点请求字段，用于设计页以未保存的编辑内容覆盖已保存的节点
+type NodeRequest struct {
+	RequestPath   string
+	RequestMethod string
+	RequestData   string
+}
+
+// RunNodeInput 单步运行节点的参数
+type RunNodeInput struct {
+	SMID      int64 // 节点所属状态机，节点 id 只在状态机内唯一
+	NodeID    string
+	SessionID int64        // 逻辑会话 id，0 表示设计页会话
+	Override  *NodeRequest // 可选：覆盖节点已保存的请求字段，仅用于设计页会话的调试运行
+
+	ExpectedVersion int64 // 可选：期望的会话版本，不一致时返回 ErrVersionConflict
+}
+
+// RunNode 在逻辑会话中运行指定节点：会话不存在则按 CreateSession 放到开始节点创建，执行节点后迁移到该节点。
+// 设计页会话（SessionID=0）可任意单步运行节点，其余会话需沿出边迁移。与 Fire 共用会话执行队列
+func (e *Engine) RunNode(ctx context.Context, in RunNodeInput) (*EventResult, error) {
+	var result *EventResult
+	var err error
+	if qerr := e.queue.Do(ctx, sessionKey(in.SMID, in.SessionID), func() {
+		result, err = e.runNode(ctx, in)
+	}); qerr != nil {
+		return nil, qerr
+	}
+	return result, err
+}
+
+func (e *Engine) runNode(ctx context.Context, in RunNodeInput) (*EventResult, error) {
+	var node orm.SMNode
+	if err := e.db.Where("sm_id = ? AND node_id = ?", in.SMID, in.NodeID).First(&node).Error; err != nil {
+		return nil, ErrNodeNotFound
+	}
+	var flow orm.SMFlow
+	if err := e.db.First(&flow, node.SMID).Error; err != nil {
+		return nil, ErrFlowNotFound
+	}
+	if in.Override != nil {
+		node.RequestPath = in.Override.RequestPath
+		node.RequestMethod = in.Override.RequestMethod
+		node.RequestData = in.Override.RequestData
+	}
+	// 会话不存在时与 CreateSession 一样放到开始节点创建，再从开始节点运行；已在会话执行队列中，不再排队
+	current, _, err := e.createSession(CreateSessionInput{SMID: node.SMID, SessionID: &in.SessionID}, in.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	// 挂起的会话不能运行节点；已结束的会话只有设计页会话可以继续单步运行
+	if current.Status == "suspended" || (current.Status == "ended" && in.SessionID != 0) {
+		return nil, fmt.Errorf("%w: 会话状态为 %s", ErrSessionNotRunning, current.Status)
+	}
+	if err := checkVersion(current, in.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	e.Notify(current, Notification{Type: NotifyNodeStarted, NodeID: node.NodeID, Event: "run_node"})
+	exec, err := e.Execute(ctx, &ExecInput{Flow: &flow, Node: &node, Session: current, Event: "run_node"})
+	if err != nil {
+		e.failNode(current, node.NodeID, "run_node", err)
+		return nil, err
+	}
+
+	t := Transition{Event: "run_node", Target: node.NodeID, Force: in.SessionID == 0}
+	exec.fill(&t)
+	var session orm.SessionInfo
+	var detail *orm.SessionDetail
+	err = e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&session, current.ID).Error; err != nil {
+			return ErrSessionNotFound
+		}
+		if session.Version != current.Version {
+			// 执行节点期间会话已被其他请求修改，按读取时的版本迁移会覆盖对方的结果
+			return fmt.Errorf("%w: 会话已被其他请求修改", ErrVersionConflict)
+		}
+		var err error
+		if detail, err = e.Apply(tx, &session, t); err != nil {
+			return fmt.Errorf("状态迁移失败: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if session.ID != 0 {
+			e.failNode(&session, node.NodeID, "run_node", err)
+		}
+		return nil, err
+	}
+	e.notifyApplied(&session, detail)
+	return &EventResult{Session: &session, Detail: detail, Response: exec.Response, Wait: exec.Wait}, nil
+}
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+// CreateSessionInput 创建会话的参数
+type CreateSessionInput struct {
+	SMID        int64
+	SessionID   *int64         // 逻辑会话 id：0 为设计页会话；为空时分配该状态机下一个未使用的 id
+	ExternalKey string         // 外部关联键，同一状态机内唯一；与 SessionID 互斥
+	Context     map[string]any // 初始会话变量
+}
+
+// errLogicalIDTaken 分配的逻辑会话 id 在排队期间已被其他请求占用，需重新分配
+var errLogicalIDTaken = errors.New("逻辑会话 id 已被占用")
+
+// CreateSession 创建会话并放到流程的开始节点，返回会话与是否新建。
+// 指定的逻辑会话 id 或外部关联键已存在时直接返回已有会话；
+// 设计页会话允许流程暂无开始节点（此时 State 为空），其余会话要求流程有开始节点。
+// 未指定逻辑会话 id 时先按外部关联键查找或分配 id，再在该会话的执行队列中创建，
+// 与同一会话的事件、运行节点等操作使用同一队列键按序执行
+func (e *Engine) CreateSession(ctx context.Context, in CreateSessionInput) (*orm.SessionInfo, bool, error) {
+	for retry := 0; ; retry++ {
+		logicalID, err := e.resolveLogicalID(in)
+		if err != nil {
+			return nil, false, err
+		}
+		var session *orm.SessionInfo
+		var created bool
+		if qerr := e.queue.Do(ctx, sessionKey(in.SMID, logicalID), func() {
+			session, created, err = e.createSession(in, logicalID)
+		}); qerr != nil {
+			return nil, false, qerr
+		}
+		if errors.Is(err, errLogicalIDTaken) && retry < 3 {
+			continue
+		}
+		return session, created, err
+	}
+}
+
+// resolveLogicalID 确定待创建会话的逻辑 id：优先使用指定的 id，其次是外部关联键对应的已有会话，
+// 否则分配该状态机下一个未使用的 id（已删除的会话仍占用唯一索引，分配时一并计入）
+func (e *Engine) resolveLogicalID(in CreateSessionInput) (int64, error) {
+	if in.SessionID != nil {
+		return *in.SessionID, nil
+	}
+	if in.ExternalKey != "" {
+		var existing orm.SessionInfo
+		err := e.db.Where("sm_id = ? AND external_key = ?", in.SMID, in.ExternalKey).First(&existing).Error
+		if err == nil {
+			return existing.LogicalSessionID, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, err
+		}
+	}
+	var logicalID int64
+	if err := e.db.Unscoped().Model(&orm.SessionInfo{}).Where("sm_id = ?", in.SMID).
+		Select("COALESCE(MAX(logical_session_id), 0) + 1").Scan(&logicalID).Error; err != nil {
+		return 0, err
+	}
+	return logicalID, nil
+}
+
+// createSession 在会话执行队列中创建逻辑 id 为 logicalID 的会话；调用方需已持有 sessionKey(in.SMID, logicalID)
+func (e *Engine) createSession(in CreateSessionInput, logicalID int64) (*orm.SessionInfo, bool, error) {
+	var session orm.SessionInfo
+	var detail *orm.SessionDetail
+	created := false
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&orm.SMFlow{}, in.SMID).Error; err != nil {
+			return ErrFlowNotFound
+		}
+		if in.ExternalKey != "" {
+			err := tx.Where("sm_id = ? AND external_key = ?", in.SMID, in.ExternalKey).First(&session).Error
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		q := tx
+		if in.SessionID == nil {
+			q = tx.Unscoped()
+		}
+		err := q.Where("sm_id = ? AND logical_session_id = ?", in.SMID, logicalID).First(&session).Error
+		switch {
+		case err == nil && in.SessionID != nil:
+			return nil
+		case err == nil:
+			session = orm.SessionInfo{}
+			return errLogicalIDTaken
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+		state := ""
+		start, err := e.StartNode(tx, in.SMID)
+		switch {
+		case err == nil:
+			state = start.NodeID
+		case !errors.Is(err, ErrNoStartNode) || logicalID != 0:
+			return err
+		}
+		session = orm.SessionInfo{
+			SMID:             in.SMID,
+			LogicalSessionID: logicalID,
+			State:            state,
+			Status:           "running",
+			Context:          EncodeContext(in.Context),
+		}
+		if in.ExternalKey != "" {
+			session.ExternalKey = &in.ExternalKey
+		}
+		if err := tx.Create(&session).Error; err != nil {
+			return fmt.Errorf("创建会话失败: %w", err)
+		}
+		created = true
+		if state == "" {
+			return nil
+		}
+		detail = &orm.SessionDetail{
+			SessionID: session.ID,
+			NodeID:    state,
+			SMID:      session.SMID,
+			Event:     "create",
+			ToState:   state,
+			Input:     "{}",
+			Output:    session.Context,
+		}
+		return recordDetail(tx, detail)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		n := Notification{Type: NotifySessionCreated, State: session.State}
+		if detail != nil {
+			n.NodeID, n.Event, n.DetailID = detail.NodeID, detail.Event, detail.ID
+		}
+		e.Notify(&session, n)
+	}
+	return &session, created, nil
+}
@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+// newTestEngine 基于内存数据库创建引擎，并建好一个流程：开始节点 s 经事件 go 迁移到 a
+func newTestEngine(t *testing.T) (*Engine, *orm.SessionInfo) {
+	t.Helper()
+	db, err := orm.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow := orm.SMFlow{Name: "test"}
+	if err := db.Create(&flow).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []orm.SMNode{
+		{SMID: flow.ID, NodeID: "s", Data: `{"data":{"nodeCategory":"scene","nodeKind":"start"}}`},
+		{SMID: flow.ID, NodeID: "a", Data: `{"data":{"nodeCategory":"scene"}}`},
+	} {
+		if err := db.Create(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&orm.SMEdge{SMID: flow.ID, EdgeID: "e1", FromNodeID: "s", ToNodeID: "a", Event: "go"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	e := New(db)
+	session, created, err := e.CreateSession(context.Background(), CreateSessionInput{SMID: flow.ID})
+	if err != nil || !created {
+		t.Fatalf("创建会话失败: %v", err)
+	}
+	return e, session
+}
+
+func TestPatchContextVersionConflict(t *testing.T) {
+	e, s := newTestEngine(t)
+	ctx := context.Background()
+	if s.Version != 1 {
+		t.Fatalf("新会话版本为 %d，want 1", s.Version)
+	}
+	updated, err := e.PatchContext(ctx, s.ID, map[string]any{"a": 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != 2 {
+		t.Fatalf("更新后版本为 %d，want 2", updated.Version)
+	}
+	if _, err := e.PatchContext(ctx, s.ID, map[string]any{"a": 2}, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("按过期版本更新: got %v, want ErrVersionConflict", err)
+	}
+	if _, err := e.Fire(ctx, s.ID, Event{Name: "go", ExpectedVersion: 1}); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("按过期版本触发事件: got %v, want ErrVersionConflict", err)
+	}
+	res, err := e.Fire(ctx, s.ID, Event{Name: "go", ExpectedVersion: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Session.State != "a" || res.Session.Version != 3 {
+		t.Fatalf("state=%s version=%d，want a 和 3", res.Session.State, res.Session.Version)
+	}
+}
+
+func TestUpdateSessionStaleVersion(t *testing.T) {
+	e, s := newTestEngine(t)
+	stale := *s
+	if err := updateSession(e.db, s, map[string]interface{}{"status": "running"}); err != nil {
+		t.Fatal(err)
+	}
+	// 另一个请求持有的旧副本不能覆盖已更新的会话
+	if err := updateSession(e.db, &stale, map[string]interface{}{"status": "ended"}); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("got %v, want ErrVersionConflict", err)
+	}
+	var got orm.SessionInfo
+	e.db.First(&got, s.ID)
+	if got.Status != "running" || got.Version != 2 {
+		t.Fatalf("status=%s version=%d，want running 和 2", got.Status, got.Version)
+	}
+}
@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/caoaolong/state-server/expr"
+	"github.com/caoaolong/state-server/orm"
+	"gorm.io/gorm"
+)
+
+var ErrTemplate = errors.New("模板渲染失败")
+
+// placeholder 匹配 {{ expr }} 占位符
+var placeholder = regexp.MustCompile(`\{\{\s*(.+?)\s*\}\}`)
+
+// Render 将 s 中的 {{ expr }} 占位符替换为表达式在 scope 中的求值结果；
+// 对象/数组输出 JSON，null 输出空串；escape 非空时对每个替换值转义
+func Render(s string, scope map[string]any, escape func(string) string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	var renderErr error
+	out := placeholder.ReplaceAllStringFunc(s, func(m string) string {
+		if renderErr != nil {
+			return m
+		}
+		src := placeholder.FindStringSubmatch(m)[1]
+		v, err := expr.Eval(src, scope)
+		if err != nil {
+			renderErr = fmt.Errorf("%w: {{ %s }}: %v", ErrTemplate, src, err)
+			return m
+		}
+		text := formatValue(v)
+		if escape != nil {
+			text = escape(text)
+		}
+		return text
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	return out, nil
+}
+
+// RenderJSON 渲染 JSON 模板（如请求体）：位于字符串字面量内的占位符按 JSON 字符串内容转义，
+// 单独作为值的占位符输出对应的 JSON 字面量（字符串带引号，null、数字、布尔、对象、数组原样），
+// 变量中的引号等字符不会破坏 JSON 结构或注入字段
+func RenderJSON(s string, scope map[string]any) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	var b strings.Builder
+	inString, escaped, last := false, false, 0
+	for _, m := range placeholder.FindAllStringSubmatchIndex(s, -1) {
+		// 扫描占位符之前的原文，判断占位符是否位于字符串字面量内
+		for _, c := range []byte(s[last:m[0]]) {
+			switch {
+			case escaped:
+				escaped = false
+			case inString && c == '\\':
+				escaped = true
+			case c == '"':
+				inString = !inString
+			}
+		}
+		b.WriteString(s[last:m[0]])
+		src := s[m[2]:m[3]]
+		v, err := expr.Eval(src, scope)
+		if err != nil {
+			return "", fmt.Errorf("%w: {{ %s }}: %v", ErrTemplate, src, err)
+		}
+		if inString {
+			v = formatValue(v)
+		}
+		text, err := jsonLiteral(v)
+		if err != nil {
+			return "", fmt.Errorf("%w: {{ %s }}: %v", ErrTemplate, src, err)
+		}
+		if inString {
+			text = text[1 : len(text)-1]
+		}
+		b.WriteString(text)
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+	return b.String(), nil
+}
+
+// jsonLiteral 将值编码为 JSON，不转义 HTML 字符
+func jsonLiteral(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// renderBody 渲染请求数据：JSON 对象或数组按 RenderJSON 渲染，其余（如表单、纯文本）按原文替换
+func renderBody(data string, scope map[string]any) (string, error) {
+	if t := strings.TrimSpace(data); strings.HasPrefix(t, "{") || strings.HasPrefix(t, "[") {
+		return RenderJSON(data, scope)
+	}
+	return Render(data, scope, nil)
+}
+
+func formatValue(v any) string {
+	switch v.(type) {
+	case map[string]any, []any:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return expr.ToString(v)
+}
+
+// DecodeConstants 解析 SMFlow.Constants
+func DecodeConstants(flow *orm.SMFlow) map[string]any {
+	return DecodeContext(flow.Constants)
+}
+
+// NewRequest 渲染节点请求路径与请求数据中的模板后构建出站请求。
+// 模板可引用 session.vars / vars、event.payload / payload、flow.constants / const 以及 response
+func (e *Engine) NewRequest(tx *gorm.DB, flow *orm.SMFlow, session *orm.SessionInfo, event string, payload map[string]any, path, method, data string) (*Request, error) {
+	scope := e.Scope(tx, session, event, payload)
+	path, err := Render(path, scope, url.PathEscape)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = renderBody(data, scope); err != nil {
+		return nil, err
+	}
+	return BuildRequest(flow, path, method, data)
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRenderJSON(t *testing.T) {
+	scope := map[string]any{
+		"vars": map[string]any{
+			"name":  `a"b`,
+			"path":  `c:\tmp`,
+			"html":  "<b>&",
+			"count": 3,
+			"ok":    true,
+			"tags":  []any{"x", "y"},
+			"user":  map[string]any{"id": 1},
+		},
+	}
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{"字符串内转义引号", `{"name":"{{ vars.name }}"}`, `{"name":"a\"b"}`},
+		{"字符串内转义反斜杠", `{"path":"dir={{ vars.path }}"}`, `{"path":"dir=c:\\tmp"}`},
+		{"不转义 HTML 字符", `{"html":"{{ vars.html }}"}`, `{"html":"<b>&"}`},
+		{"整值字符串带引号", `{"name":{{ vars.name }}}`, `{"name":"a\"b"}`},
+		{"整值数字", `{"count":{{ vars.count }}}`, `{"count":3}`},
+		{"整值布尔", `{"ok":{{ vars.ok }}}`, `{"ok":true}`},
+		{"整值数组", `{"tags":{{ vars.tags }}}`, `{"tags":["x","y"]}`},
+		{"整值对象", `{"user":{{ vars.user }}}`, `{"user":{"id":1}}`},
+		{"整值缺失为 null", `{"missing":{{ vars.missing }}}`, `{"missing":null}`},
+		{"字符串内对象为 JSON 文本", `{"user":"{{ vars.user }}"}`, `{"user":"{\"id\":1}"}`},
+		{"字符串内的转义引号不影响判断", `{"a":"x\"y","b":"{{ vars.name }}"}`, `{"a":"x\"y","b":"a\"b"}`},
+		{"数组", `[{{ vars.count }},"{{ vars.name }}"]`, `[3,"a\"b"]`},
+		{"无占位符", `{"a":1}`, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderJSON(tt.tmpl, scope)
+			if err != nil {
+				t.Fatalf("RenderJSON(%q) error: %v", tt.tmpl, err)
+			}
+			if got != tt.want {
+				t.Fatalf("RenderJSON(%q) = %s, want %s", tt.tmpl, got, tt.want)
+			}
+			if !json.Valid([]byte(got)) {
+				t.Fatalf("RenderJSON(%q) = %s, not valid JSON", tt.tmpl, got)
+			}
+		})
+	}
+}
+
+func TestRenderBody(t *testing.T) {
+	scope := map[string]any{"vars": map[string]any{"name": `a"b`}}
+	got, err := renderBody(`{"name":"{{ vars.name }}"}`, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]string
+	if err := json.Unmarshal([]byte(got), &v); err != nil || v["name"] != `a"b` {
+		t.Fatalf("renderBody JSON = %s, err %v", got, err)
+	}
+	// 非 JSON 请求体按原文替换
+	got, err = renderBody(`name={{ vars.name }}`, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `name=a"b` {
+		t.Fatalf("renderBody text = %s", got)
+	}
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+)
+
+// WebhookEvents 可订阅的 Webhook 事件：会话创建、状态迁移、到达结束节点、节点执行失败、会话挂起
+var WebhookEvents = []string{NotifySessionCreated, NotifyStateChanged, NotifySessionEnded, NotifyNodeFailed, NotifySessionSuspended}
+
+const (
+	webhookMaxAttempts  = 6                // 最多投递次数（含首次）
+	webhookBackoff      = 10 * time.Second // 首次重试间隔，之后每次乘以 4
+	webhookTimeout      = 10 * time.Second // 单次投递超时
+	webhookPollInterval = time.Second      // 扫描待投递记录的间隔
+	webhookBatch        = 16               // 每轮并发投递的记录数
+	webhookBodyLimit    = 4096             // 记录的响应体上限（字节）
+)
+
+// WebhookPayload Webhook 请求体
+type WebhookPayload struct {
+	Event string       `json:"event"`
+	Time  time.Time    `json:"time"`
+	Data  Notification `json:"data"`
+}
+
+// webhookClient 投递 Webhook 使用的客户端，不跟随流程的出站请求配置
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// StartWebhooks 开始在后台投递与重试 Webhook。投递记录由 Notify 在会话变更提交后同步生成并保存在数据库中，
+// 不经过会丢弃通知的通知总线；服务重启后未完成的投递会继续
+func (e *Engine) StartWebhooks() {
+	go func() {
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.webhookWake:
+			}
+			e.deliverDueWebhooks()
+		}
+	}()
+}
+
+// notifyWebhooks 为 Webhook 事件生成投递记录，有新记录时唤醒投递协程
+func (e *Engine) notifyWebhooks(n Notification) {
+	if !slices.Contains(WebhookEvents, n.Type) {
+		return
+	}
+	if e.enqueueWebhooks(n) > 0 {
+		select {
+		case e.webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// enqueueWebhooks 为订阅了该事件的已启用 Webhook 各生成一条待投递记录，返回记录数
+func (e *Engine) enqueueWebhooks(n Notification) int {
+	var hooks []orm.SMWebhook
+	if err := e.db.Where("sm_id = ? AND enabled = ?", n.FlowID, true).Find(&hooks).Error; err != nil {
+		log.Println("查询 Webhook 失败:", err)
+		return 0
+	}
+	body, _ := json.Marshal(WebhookPayload{Event: n.Type, Time: n.Time, Data: n})
+	now := time.Now()
+	count := 0
+	for _, h := range hooks {
+		if !WebhookSubscribed(h, n.Type) {
+			continue
+		}
+		d := orm.SMWebhookDelivery{
+			WebhookID:     h.ID,
+			SessionID:     n.SessionID,
+			Event:         n.Type,
+			Payload:       string(body),
+			Status:        "pending",
+			NextAttemptAt: &now,
+		}
+		if err := e.db.Create(&d).Error; err != nil {
+			log.Println("写入 Webhook 投递记录失败:", err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// WebhookSubscribed 判断 Webhook 是否订阅了事件；未指定事件时订阅全部
+func WebhookSubscribed(h orm.SMWebhook, event string) bool {
+	if strings.TrimSpace(h.Events) == "" {
+		return true
+	}
+	for _, ev := range strings.Split(h.Events, ",") {
+		if strings.TrimSpace(ev) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverDueWebhooks 并发投递一批到期的记录，全部完成后返回
+func (e *Engine) deliverDueWebhooks() {
+	var due []orm.SMWebhookDelivery
+	if err := e.db.Where("status = ? AND next_attempt_at <= ?", "pending", time.Now()).
+		Order("next_attempt_at, id").Limit(webhookBatch).Find(&due).Error; err != nil {
+		log.Println("查询待投递 Webhook 失败:", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := range due {
+		wg.Add(1)
+		go func(d *orm.SMWebhookDelivery) {
+			defer wg.Done()
+			e.deliverWebhook(d)
+		}(&due[i])
+	}
+	wg.Wait()
+}
+
+// deliverWebhook 投递一次并记录结果：2xx 为成功，否则按指数退避安排重试，超过次数后标记为失败
+func (e *Engine) deliverWebhook(d *orm.SMWebhookDelivery) {
+	var hook orm.SMWebhook
+	attempt := Attempt{Attempt: d.AttemptCount + 1}
+	updates := map[string]interface{}{"attempt_count": attempt.Attempt}
+	if err := e.db.First(&hook, d.WebhookID).Error; err != nil {
+		updates["status"], updates["error"], updates["next_attempt_at"] = "failed", "Webhook 已删除", nil
+		e.db.Model(d).Updates(updates)
+		return
+	}
+
+	start := time.Now()
+	code, body, err := sendWebhook(hook, d)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	attempt.StatusCode = code
+	updates["response_code"], updates["response_body"], updates["error"] = code, body, ""
+	switch {
+	case err != nil:
+		attempt.Error = err.Error()
+	case code < 200 || code >= 300:
+		attempt.Error = "响应状态码 " + strconv.Itoa(code)
+	}
+	attempts := append(DecodeAttempts(d.Attempts), attempt)
+	raw, _ := json.Marshal(attempts)
+	updates["attempts"] = string(raw)
+
+	switch {
+	case attempt.Error == "":
+		updates["status"], updates["next_attempt_at"] = "success", nil
+	case attempt.Attempt >= webhookMaxAttempts:
+		updates["status"], updates["error"], updates["next_attempt_at"] = "failed", attempt.Error, nil
+	default:
+		next := time.Now().Add(webhookBackoff << (2 * (attempt.Attempt - 1)))
+		updates["error"], updates["next_attempt_at"] = attempt.Error, next
+	}
+	if err := e.db.Model(d).Updates(updates).Error; err != nil {
+		log.Println("更新 Webhook 投递记录失败:", err)
+	}
+}
+
+// sendWebhook 发送签名的 POST 请求，返回状态码与截断后的响应体。
+// 签名方式与流程的 HMAC 认证一致：X-Webhook-Signature 为
+// HMAC-SHA256(secret, "POST\n" + 请求 URI + "\n" + X-Webhook-Timestamp + "\n" + 请求体) 的十六进制
+func sendWebhook(hook orm.SMWebhook, d *orm.SMWebhookDelivery) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "state-server-webhook")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	if hook.Secret != "" {
+		signer := &HMACSigner{Key: []byte(hook.Secret), Algorithm: "sha256", Header: "X-Webhook-Signature", TimestampHeader: "X-Webhook-Timestamp"}
+		signer.Sign(req, d.Payload, time.Now())
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookBodyLimit))
+	return resp.StatusCode, string(body), nil
+}
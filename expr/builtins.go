@@ -0,0 +1,115 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// builtins 内置函数表
+var builtins = map[string]func(args []any) (any, error){
+	"len": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("len 需要 1 个参数")
+		}
+		switch x := args[0].(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			return float64(len([]rune(x))), nil
+		}
+		rv := reflect.ValueOf(args[0])
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return float64(rv.Len()), nil
+		}
+		return nil, fmt.Errorf("len 不支持 %s", typeName(args[0]))
+	},
+	"contains": func(args []any) (any, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("contains 需要 2 个参数")
+		}
+		switch x := args[0].(type) {
+		case nil:
+			return false, nil
+		case string:
+			return strings.Contains(x, ToString(args[1])), nil
+		case map[string]any:
+			_, ok := x[ToString(args[1])]
+			return ok, nil
+		}
+		rv := reflect.ValueOf(args[0])
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			for i := 0; i < rv.Len(); i++ {
+				if equal(rv.Index(i).Interface(), args[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return nil, fmt.Errorf("contains 不支持 %s", typeName(args[0]))
+	},
+	"lower": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("lower 需要 1 个参数")
+		}
+		return strings.ToLower(ToString(args[0])), nil
+	},
+	"upper": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("upper 需要 1 个参数")
+		}
+		return strings.ToUpper(ToString(args[0])), nil
+	},
+	"string": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("string 需要 1 个参数")
+		}
+		return ToString(args[0]), nil
+	},
+	"json": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("json 需要 1 个参数")
+		}
+		b, err := json.Marshal(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	},
+	"number": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("number 需要 1 个参数")
+		}
+		switch x := args[0].(type) {
+		case float64:
+			return x, nil
+		case bool:
+			if x {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, fmt.Errorf("无法将 %q 转为数字", x)
+			}
+			return f, nil
+		}
+		return nil, fmt.Errorf("number 不支持 %s", typeName(args[0]))
+	},
+}
+
+func (n *call) eval(env map[string]any) (any, error) {
+	args := make([]any, 0, len(n.args))
+	for _, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return builtins[n.name](args)
+}
@@ -0,0 +1,341 @@
+// Package expr 轻量表达式求值器，用于边的守卫条件与请求模板
+//
+// 支持：数字/字符串/true/false/null 字面量，变量与属性访问（a.b、a["b"]、a[0]），
+// 运算符 ! - * / % + - < <= > >= == != && ||，以及内置函数 len、contains、lower、upper、string、number、json。
+// 访问不存在的属性得到 null，引用未定义的顶层变量视为错误。
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Program 编译后的表达式，可对不同环境重复求值
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile 解析表达式
+func Compile(src string) (*Program, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("位置 %d: 多余的 %q", t.pos, t.text)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+// String 返回表达式源码
+func (p *Program) String() string { return p.src }
+
+// Eval 在环境 env 中求值
+func (p *Program) Eval(env map[string]any) (any, error) {
+	return p.root.eval(env)
+}
+
+// Eval 解析并求值表达式
+func Eval(src string, env map[string]any) (any, error) {
+	p, err := Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return p.Eval(env)
+}
+
+// EvalBool 解析并求值表达式，结果按 Truthy 转为布尔值
+func EvalBool(src string, env map[string]any) (bool, error) {
+	v, err := Eval(src, env)
+	if err != nil {
+		return false, err
+	}
+	return Truthy(v), nil
+}
+
+// Truthy 判断值的真假：null、false、0、空字符串与空集合为假
+func Truthy(v any) bool {
+	switch x := normalize(v).(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() > 0
+	}
+	return true
+}
+
+// ToString 将值格式化为字符串：整数不带小数点，null 为空串，集合输出 JSON 风格
+func ToString(v any) string {
+	switch x := normalize(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1e15 {
+			return strconv.FormatInt(int64(x), 10)
+		}
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// normalize 将各种整数/浮点类型统一为 float64
+func normalize(v any) any {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int8:
+		return float64(x)
+	case int16:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint:
+		return float64(x)
+	case uint8:
+		return float64(x)
+	case uint16:
+		return float64(x)
+	case uint32:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	}
+	return v
+}
+
+func (n *literal) eval(map[string]any) (any, error) { return n.value, nil }
+
+func (n *ident) eval(env map[string]any) (any, error) {
+	v, ok := env[n.name]
+	if !ok {
+		return nil, fmt.Errorf("未定义的变量 %s", n.name)
+	}
+	return normalize(v), nil
+}
+
+func (n *member) eval(env map[string]any) (any, error) {
+	obj, err := n.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(index(obj, key)), nil
+}
+
+// index 取 obj[key]；对象取属性、数组取下标，不存在时返回 nil
+func index(obj, key any) any {
+	if obj == nil {
+		return nil
+	}
+	switch o := obj.(type) {
+	case map[string]any:
+		return o[ToString(key)]
+	case []any:
+		i, ok := normalize(key).(float64)
+		if !ok || i < 0 || int(i) >= len(o) {
+			return nil
+		}
+		return o[int(i)]
+	}
+	rv := reflect.ValueOf(obj)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		v := rv.MapIndex(reflect.ValueOf(ToString(key)).Convert(rv.Type().Key()))
+		if !v.IsValid() {
+			return nil
+		}
+		return v.Interface()
+	case reflect.Slice, reflect.Array:
+		i, ok := normalize(key).(float64)
+		if !ok || i < 0 || int(i) >= rv.Len() {
+			return nil
+		}
+		return rv.Index(int(i)).Interface()
+	}
+	return nil
+}
+
+func (n *unary) eval(env map[string]any) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !Truthy(v), nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("运算符 - 需要数字，得到 %s", typeName(v))
+	}
+	return -f, nil
+}
+
+func (n *binary) eval(env map[string]any) (any, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// 逻辑运算短路
+	switch n.op {
+	case "&&":
+		if !Truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		return Truthy(right), nil
+	case "||":
+		if Truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		return Truthy(right), nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n.op, left, right)
+	case "+":
+		if ls, ok := left.(string); ok {
+			return ls + ToString(right), nil
+		}
+		if rs, ok := right.(string); ok {
+			return ToString(left) + rs, nil
+		}
+	}
+	lf, lok := left.(float64)
+	rf, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("运算符 %s 需要数字，得到 %s 与 %s", n.op, typeName(left), typeName(right))
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("除数为 0")
+		}
+		return lf / rf, nil
+	case "%":
+		if rf == 0 {
+			return nil, fmt.Errorf("除数为 0")
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("未知运算符 %s", n.op)
+}
+
+func equal(a, b any) bool {
+	a, b = normalize(a), normalize(b)
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case float64, string, bool:
+		return a == b
+	default:
+		return reflect.DeepEqual(x, b)
+	}
+}
+
+func compare(op string, a, b any) (bool, error) {
+	var c int
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return false, fmt.Errorf("无法比较 %s 与 %s", typeName(a), typeName(b))
+		}
+		switch {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return false, fmt.Errorf("无法比较 %s 与 %s", typeName(a), typeName(b))
+		}
+		c = strings.Compare(x, y)
+	default:
+		return false, fmt.Errorf("无法比较 %s 与 %s", typeName(a), typeName(b))
+	}
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func typeName(v any) string {
+	switch normalize(v).(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,170 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+func testEnv() map[string]any {
+	return map[string]any{
+		"vars": map[string]any{
+			"count": 3,
+			"name":  "Alice",
+			"tags":  []any{"a", "b"},
+			"user":  map[string]any{"age": 20, "email": ""},
+			"empty": []any{},
+		},
+		"event": "submit",
+		"订单":    map[string]any{"金额": 120, "状态": "待审批"},
+		"变量1":   "x",
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		// 优先级
+		{"乘法优先于加法", "1 + 2 * 3", float64(7)},
+		{"括号", "(1 + 2) * 3", float64(9)},
+		{"减法左结合", "10 - 3 - 2", float64(5)},
+		{"取模", "7 % 4 + 1", float64(4)},
+		{"一元负号", "-2 * 3", float64(-6)},
+		{"比较优先于相等", "1 < 2 == true", true},
+		{"与优先于或", "true || false && false", true},
+		{"非优先于与", "!false && false", false},
+		{"算术优先于比较", "vars.count + 1 > 3", true},
+
+		// 短路
+		{"与短路跳过未定义变量", "false && undefined", false},
+		{"或短路跳过未定义变量", "true || undefined", true},
+		{"与短路跳过除零", "vars.count > 5 && 1 / 0 > 0", false},
+		{"与的结果为布尔", "1 && \"x\"", true},
+		{"或的结果为布尔", "0 || \"\"", false},
+
+		// 缺失属性
+		{"缺失属性为 null", "vars.missing", nil},
+		{"缺失属性的属性为 null", "vars.missing.deep", nil},
+		{"缺失属性等于 null", "vars.missing == null", true},
+		{"缺失属性为假", "!vars.missing", true},
+		{"数组越界为 null", "vars.tags[5]", nil},
+		{"下标访问", "vars.tags[1]", "b"},
+		{"字符串键访问", "vars[\"name\"]", "Alice"},
+
+		// 非 ASCII 标识符
+		{"中文变量与属性", "订单.金额 > 100", true},
+		{"中文属性比较", "订单.状态 == \"待审批\"", true},
+		{"中文标识符含数字", "变量1 + 订单.金额", "x120"},
+		{"中文缺失属性", "订单.备注 == null", true},
+
+		// 字符串
+		{"字符串拼接", "vars.name + \"-\" + vars.count", "Alice-3"},
+		{"字符串比较", "\"a\" < \"b\"", true},
+		{"整数与浮点相等", "vars.count == 3.0", true},
+
+		// number
+		{"number 字符串", "number(\" 42 \")", float64(42)},
+		{"number 小数", "number(\"1.5\") * 2", float64(3)},
+		{"number 布尔", "number(true) + number(false)", float64(1)},
+		{"number 数字", "number(vars.count)", float64(3)},
+
+		// len
+		{"len 字符串按字符", "len(\"你好\")", float64(2)},
+		{"len 数组", "len(vars.tags)", float64(2)},
+		{"len 对象", "len(vars.user)", float64(2)},
+		{"len null", "len(vars.missing)", float64(0)},
+		{"len 空数组", "len(vars.empty) == 0", true},
+
+		// contains
+		{"contains 字符串", "contains(vars.name, \"lic\")", true},
+		{"contains 数组", "contains(vars.tags, \"b\")", true},
+		{"contains 数组不含", "contains(vars.tags, \"c\")", false},
+		{"contains 对象键", "contains(vars.user, \"age\")", true},
+		{"contains null", "contains(vars.missing, \"a\")", false},
+	}
+	env := testEnv()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Eval(tt.src, env)
+			if err != nil {
+				t.Fatalf("Eval(%q) error: %v", tt.src, err)
+			}
+			if got != tt.want {
+				t.Fatalf("Eval(%q) = %#v, want %#v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"未定义变量", "undefined > 1", "未定义的变量"},
+		{"或不短路时求值右侧", "false || undefined", "未定义的变量"},
+		{"除零", "1 / 0", "除数为 0"},
+		{"数字与字符串比较", "vars.count > \"2\"", "无法比较"},
+		{"number 无法转换", "number(\"abc\")", "无法将"},
+		{"number 不支持对象", "number(vars.user)", "number 不支持"},
+		{"len 参数个数", "len()", "len 需要 1 个参数"},
+		{"len 不支持数字", "len(vars.count)", "len 不支持"},
+		{"contains 参数个数", "contains(vars.tags)", "contains 需要 2 个参数"},
+	}
+	env := testEnv()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Eval(tt.src, env)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Eval(%q) error = %v, want %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"vars.",
+		"vars[0",
+		"1 2",
+		"unknown(1)",
+		"\"unterminated",
+		"a && || b",
+		"订单.金额 ＞ 1",
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("Compile(%q) 应当失败", src)
+		}
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"vars.user.age >= 18 && event == \"submit\"", true},
+		{"vars.user.email", false},
+		{"vars.tags", true},
+		{"vars.empty", false},
+		{"vars.missing", false},
+		{"0", false},
+		{"\"0\"", true},
+	}
+	env := testEnv()
+	for _, tt := range tests {
+		got, err := EvalBool(tt.src, env)
+		if err != nil {
+			t.Fatalf("EvalBool(%q) error: %v", tt.src, err)
+		}
+		if got != tt.want {
+			t.Errorf("EvalBool(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
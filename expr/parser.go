@@ -0,0 +1,208 @@
+package expr
+
+import "fmt"
+
+// node 语法树节点
+type node interface {
+	eval(env map[string]any) (any, error)
+}
+
+type (
+	literal struct{ value any }
+	ident   struct{ name string }
+	member  struct {
+		object node
+		key    node // 点访问时为字符串字面量
+	}
+	unary struct {
+		op      string
+		operand node
+	}
+	binary struct {
+		op          string
+		left, right node
+	}
+	call struct {
+		name string
+		args []node
+	}
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) acceptOp(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expectOp(op string) error {
+	if _, ok := p.acceptOp(op); !ok {
+		t := p.peek()
+		return fmt.Errorf("位置 %d: 期望 %q", t.pos, op)
+	}
+	return nil
+}
+
+// parseBinary 解析左结合的二元运算层级
+func (p *parser) parseBinary(operand func() (node, error), ops ...string) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.acceptOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseExpr() (node, error) { return p.parseOr() }
+
+func (p *parser) parseOr() (node, error) { return p.parseBinary(p.parseAnd, "||") }
+
+func (p *parser) parseAnd() (node, error) { return p.parseBinary(p.parseEquality, "&&") }
+
+func (p *parser) parseEquality() (node, error) {
+	return p.parseBinary(p.parseRelational, "==", "!=")
+}
+
+func (p *parser) parseRelational() (node, error) {
+	return p.parseBinary(p.parseAdditive, "<=", ">=", "<", ">")
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if op, ok := p.acceptOp("!", "-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: op, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOp("."); ok {
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("位置 %d: \".\" 之后需要属性名", t.pos)
+			}
+			n = &member{object: n, key: &literal{value: t.text}}
+			continue
+		}
+		if _, ok := p.acceptOp("["); ok {
+			key, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			n = &member{object: n, key: key}
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literal{value: t.num}, nil
+	case tokString:
+		return &literal{value: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null", "nil":
+			return &literal{value: nil}, nil
+		}
+		if _, ok := p.acceptOp("("); ok {
+			return p.parseCall(t)
+		}
+		return &ident{name: t.text}, nil
+	case tokOp:
+		if t.text == "(" {
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("表达式意外结束")
+	}
+	return nil, fmt.Errorf("位置 %d: 意外的 %q", t.pos, t.text)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	if _, ok := builtins[name.text]; !ok {
+		return nil, fmt.Errorf("位置 %d: 未知函数 %s", name.pos, name.text)
+	}
+	c := &call{name: name.text}
+	if _, ok := p.acceptOp(")"); ok {
+		return c, nil
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+		if _, ok := p.acceptOp(","); ok {
+			continue
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
@@ -2,35 +2,49 @@ package orm
 
 import (
 	"log"
+	"sync"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-var db *gorm.DB
+var (
+	db     *gorm.DB
+	dbOnce sync.Once
+)
 
-// DB 返回 GORM 实例，供路由层使用
+// DB 返回 GORM 实例，供路由层使用；首次调用时打开 smdb.db 并同步数据库结构
 func DB() *gorm.DB {
+	dbOnce.Do(func() {
+		var err error
+		if db, err = Open("smdb.db"); err != nil {
+			log.Fatal(err)
+		}
+	})
 	return db
 }
 
-func init() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("smdb.db"), &gorm.Config{
+// Open 打开 SQLite 数据库并同步数据库结构；测试可传 ":memory:" 使用内存数据库
+func Open(dsn string) (*gorm.DB, error) {
+	conn, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return nil, err
 	}
-	sqlDB, _ := db.DB()
 	sqlDB.SetMaxOpenConns(1)
 	sqlDB.SetMaxIdleConns(1)
-	db.Exec(`PRAGMA journal_mode = WAL;`)
-	db.Exec(`PRAGMA synchronous = NORMAL;`)
+	conn.Exec(`PRAGMA journal_mode = WAL;`)
+	conn.Exec(`PRAGMA synchronous = NORMAL;`)
 
 	// 同步数据库结构
-	db.AutoMigrate(&SMFlow{})
-
-	Migrate()
+	if err := Migrate(conn); err != nil {
+		return nil, err
+	}
+	return conn, nil
 }
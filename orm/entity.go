@@ -1,7 +1,6 @@
 package orm
 
 import (
-	"log"
 	"time"
 
 	"gorm.io/gorm"
@@ -14,22 +13,103 @@ type SMFlow struct {
 	Name        string         `gorm:"not null"`
 	Description string         `gorm:"default:''"`
 	BaseURL     string         `gorm:"default:''"` // 请求基础地址，与节点请求路径拼接
+	Constants   string         `gorm:"type:text;not null;default:'{}'"` // 流程级常量（JSON 对象），供请求模板引用
+	HTTPOptions string         `gorm:"type:text;default:''"`           // 出站请求默认配置（JSON）：超时、重试、TLS、代理
+	Headers     string         `gorm:"type:text;default:''"`           // 默认请求头（JSON 数组），值支持模板
+	Auth        string         `gorm:"type:text;default:''"`           // 默认认证方式（JSON）：bearer、basic、hmac
 	DeletedAt   gorm.DeletedAt `gorm:"index"`
 	CreatedAt   time.Time      `gorm:"autoCreateTime:nano"`
 	UpdatedAt   time.Time      `gorm:"autoUpdateTime:nano"`
 }
 
-// SMApiKey ApiKey 管理表，表名 sm_apikey
+// SMApiKey ApiKey 管理表，表名 sm_apikey；只保存加盐哈希，明文仅在创建/刷新时返回一次
 type SMApiKey struct {
+	ID         int64          `gorm:"primaryKey"`
+	Name       string         `gorm:"not null;size:128"`                 // 名称/备注
+	ApiKey     string         `gorm:"not null;size:256"`                 // 旧版明文密钥，启动时迁移为哈希后清空
+	Prefix     string         `gorm:"not null;default:'';size:32;index"` // 查找前缀，如 smKey-1a2b3c4d，可公开展示
+	Salt       string         `gorm:"not null;default:'';size:64"`       // 哈希盐
+	KeyHash    string         `gorm:"not null;default:'';size:128"`      // SHA-256(salt + key)
+	Scopes     string         `gorm:"not null;default:''"`               // 权限范围，逗号分隔：read、design、run、admin，为空视为 admin
+	FlowIDs    string         `gorm:"not null;default:''"`               // 可访问的状态机 id，逗号分隔，为空表示不限制
+	ExpiresAt  *time.Time     `gorm:"default:null"`                      // 过期时间，为空表示永不过期
+	LastUsedAt *time.Time     `gorm:"default:null"`                      // 最近一次鉴权通过的时间
+	UsageCount int64          `gorm:"not null;default:0"`                // 鉴权通过的请求次数
+	DeletedAt  gorm.DeletedAt `gorm:"index"`
+	CreatedAt  time.Time      `gorm:"autoCreateTime:nano"`
+	UpdatedAt  time.Time      `gorm:"autoUpdateTime:nano"`
+}
+
+func (SMApiKey) TableName() string { return "sm_apikey" }
+
+// SMApiKeyAudit API Key 调用审计：哪个 Key 在何时调用了哪个路由，表名 sm_apikey_audit
+type SMApiKeyAudit struct {
+	ID        int64     `gorm:"primaryKey"`
+	ApiKeyID  int64     `gorm:"not null;index"`
+	Method    string    `gorm:"not null;size:16"`
+	Route     string    `gorm:"not null;default:''"` // 路由模板，如 /sessions/:id/events
+	Path      string    `gorm:"not null;default:''"` // 实际请求路径
+	Status    int       `gorm:"not null;default:0"`  // 响应状态码
+	ClientIP  string    `gorm:"not null;default:''"`
+	CreatedAt time.Time `gorm:"autoCreateTime:nano;index"`
+}
+
+func (SMApiKeyAudit) TableName() string { return "sm_apikey_audit" }
+
+// SMSecret 流程密钥：请求头与认证配置中通过 {{ secret.<name> }} 引用，明文不随节点数据返回
+type SMSecret struct {
+	ID        int64     `gorm:"primaryKey"`
+	SMID      int64     `gorm:"not null;index:idx_sm_secret,unique"`
+	Name      string    `gorm:"not null;size:128;index:idx_sm_secret,unique"`
+	Value     string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime:nano"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime:nano"`
+}
+
+// SMWebhook 流程的 Webhook：会话生命周期事件发生时向 URL 投递签名的 POST 请求
+type SMWebhook struct {
 	ID        int64          `gorm:"primaryKey"`
-	Name      string         `gorm:"not null;size:128"` // 名称/备注
-	ApiKey    string         `gorm:"not null;size:256"` // 密钥
+	SMID      int64          `gorm:"not null;index"`
+	URL       string         `gorm:"not null"`
+	Events    string         `gorm:"not null;default:''"`   // 订阅的事件，逗号分隔，为空表示全部
+	Secret    string         `gorm:"not null;default:''"`   // 签名密钥（HMAC-SHA256）
+	Enabled   bool           `gorm:"not null;default:true"` // 停用后不再产生新的投递
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 	CreatedAt time.Time      `gorm:"autoCreateTime:nano"`
 	UpdatedAt time.Time      `gorm:"autoUpdateTime:nano"`
 }
 
-func (SMApiKey) TableName() string { return "sm_apikey" }
+// SMWebhookDelivery Webhook 投递记录：每个事件一条，重试时更新尝试次数与最近一次响应
+type SMWebhookDelivery struct {
+	ID            int64      `gorm:"primaryKey"`
+	WebhookID     int64      `gorm:"not null;index"`
+	SessionID     int64      `gorm:"not null;default:0"`
+	Event         string     `gorm:"not null"`
+	Payload       string     `gorm:"type:text;not null"`             // 请求体（JSON）
+	Status        string     `gorm:"not null;default:pending;index"` // pending | success | failed
+	AttemptCount  int        `gorm:"not null;default:0"`
+	Attempts      string     `gorm:"type:text;default:''"` // 每次尝试的记录（JSON 数组）
+	ResponseCode  int        `gorm:"not null;default:0"`   // 最近一次响应状态码
+	ResponseBody  string     `gorm:"type:text;default:''"` // 最近一次响应体（截断）
+	Error         string     `gorm:"type:text;default:''"` // 最近一次失败原因
+	NextAttemptAt *time.Time `gorm:"default:null;index"`   // 下次投递时间，成功或放弃后为空
+	CreatedAt     time.Time  `gorm:"autoCreateTime:nano"`
+	UpdatedAt     time.Time  `gorm:"autoUpdateTime:nano"`
+}
+
+// SMIdempotencyKey 幂等键：同一作用域（会话）内同一 Idempotency-Key 的首个请求结果，有效期内对重复请求原样重放
+type SMIdempotencyKey struct {
+	ID           int64     `gorm:"primaryKey"`
+	Scope        string    `gorm:"not null;size:128;index:idx_idempotency_scope_key,unique"` // 作用域，如 session:1
+	Key          string    `gorm:"not null;size:255;index:idx_idempotency_scope_key,unique"`
+	RequestHash  string    `gorm:"not null;size:64"`            // 请求内容摘要，同一个键用于不同请求时拒绝
+	Status       string    `gorm:"not null;default:processing"` // processing | done
+	ResponseCode int       `gorm:"not null;default:0"`          // 首个请求的响应状态码
+	ResponseBody string    `gorm:"type:text;default:''"`        // 首个请求的响应体（JSON）
+	ExpiresAt    time.Time `gorm:"not null;index"`              // 过期后该键可重新使用
+	CreatedAt    time.Time `gorm:"autoCreateTime:nano"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime:nano"`
+}
 
 // SMNode 流程节点：NodeID 为前端 id，Data 为 JSON；请求地址不包含 base_url
 type SMNode struct {
@@ -42,6 +122,10 @@ type SMNode struct {
 	RequestPath   string         `gorm:"default:''"`           // 请求地址（不包含 base_url）
 	RequestMethod string         `gorm:"default:''"`           // 请求方法，如 GET/POST
 	RequestData   string         `gorm:"type:text;default:''"` // 请求体/参数（如 JSON）
+	Extract       string         `gorm:"type:text;default:''"` // 响应提取规则（JSON 数组），把响应值写入会话变量
+	HTTPOptions   string         `gorm:"type:text;default:''"` // 出站请求配置（JSON），逐项覆盖流程级配置
+	Headers       string         `gorm:"type:text;default:''"` // 请求头（JSON 数组），同名覆盖流程级请求头
+	Auth          string         `gorm:"type:text;default:''"` // 认证方式（JSON），设置后替代流程级认证
 	DeletedAt     gorm.DeletedAt `gorm:"index"`
 	CreatedAt     time.Time      `gorm:"autoCreateTime:nano"`
 	UpdatedAt     time.Time      `gorm:"autoUpdateTime:nano"`
@@ -49,33 +133,43 @@ type SMNode struct {
 
 // SMEdge 流程边：EdgeID 为前端边 id，FromNodeID/ToNodeID 为前端节点 id
 type SMEdge struct {
-	ID         int64          `gorm:"primaryKey"`
-	SMID       int64          `gorm:"not null;index"`
-	EdgeID     string         `gorm:"not null;size:256"` // 前端边 id
-	FromNodeID string         `gorm:"not null;size:128"`
-	ToNodeID   string         `gorm:"not null;size:128"`
-	DeletedAt  gorm.DeletedAt `gorm:"index"`
-	CreatedAt  time.Time      `gorm:"autoCreateTime:nano"`
-	UpdatedAt  time.Time      `gorm:"autoUpdateTime:nano"`
+	ID           int64          `gorm:"primaryKey"`
+	SMID         int64          `gorm:"not null;index"`
+	EdgeID       string         `gorm:"not null;size:256"` // 前端边 id
+	FromNodeID   string         `gorm:"not null;size:128"`
+	ToNodeID     string         `gorm:"not null;size:128"`
+	SourceHandle string         `gorm:"default:''"`           // 起点 handle，如选择节点的 source-0
+	TargetHandle string         `gorm:"default:''"`           // 终点 handle
+	Event        string         `gorm:"default:''"`           // 触发该边的事件名
+	Label        string         `gorm:"default:''"`           // 展示名称
+	Priority     int            `gorm:"not null;default:0"`   // 多条边同时满足时，优先级高者先匹配
+	Guard        string         `gorm:"type:text;default:''"` // 守卫表达式，为空表示总是可通过
+	DeletedAt    gorm.DeletedAt `gorm:"index"`
+	CreatedAt    time.Time      `gorm:"autoCreateTime:nano"`
+	UpdatedAt    time.Time      `gorm:"autoUpdateTime:nano"`
 }
 
 // SessionInfo 会话主表：关联状态机，当前状态与运行状态
 type SessionInfo struct {
 	ID               int64          `gorm:"primaryKey"`
-	SMID             int64          `gorm:"not null;index:idx_sm_logical,unique"`
+	SMID             int64          `gorm:"not null;index:idx_sm_logical,unique;index:idx_sm_external,unique"`
 	LogicalSessionID int64          `gorm:"not null;default:0;index:idx_sm_logical,unique"` // 逻辑会话 id，0 表示设计页会话
+	ExternalKey      *string        `gorm:"size:128;index:idx_sm_external,unique"`           // 外部关联键，同一状态机内唯一；未指定时为 NULL
 	State            string         `gorm:"not null;default:''"`                             // 当前所处状态（节点/状态名）
 	Status           string         `gorm:"not null;default:running"`                        // running | ended | suspended
+	Context          string         `gorm:"type:text;not null;default:'{}'"`                  // 会话变量（JSON 对象），沿途收集的数据
+	Version          int64          `gorm:"not null;default:1"`                              // 版本号，每次更新会话加一，用于乐观并发控制
 	DeletedAt        gorm.DeletedAt `gorm:"index"`
 	CreatedAt        time.Time      `gorm:"autoCreateTime:nano"`
 	UpdatedAt        time.Time      `gorm:"autoUpdateTime:nano"`
 }
 
-// SessionDetail 会话历史明细：一次状态迁移记录（按 session+node 存在则更新）
+// SessionDetail 会话历史明细：每次状态迁移、失败与生命周期操作追加一条，按 Seq 排列即为会话的完整事件日志
 type SessionDetail struct {
 	ID           int64          `gorm:"primaryKey"`
-	SessionID    int64          `gorm:"not null;index:idx_session_node,unique"`
-	NodeID       string         `gorm:"not null;size:128;index:idx_session_node,unique"` // 节点 id，与 session 确定唯一
+	SessionID    int64          `gorm:"not null;index:idx_session_seq,unique;index:idx_session_detail_node"`
+	Seq          int64          `gorm:"not null;default:0;index:idx_session_seq,unique"` // 会话内序号，从 1 开始单调递增
+	NodeID       string         `gorm:"not null;size:128;index:idx_session_detail_node"` // 节点 id
 	SMID         int64          `gorm:"not null"`
 	Event        string         `gorm:"not null;default:''"`
 	FromState    string         `gorm:"not null;default:''"`
@@ -83,24 +177,69 @@ type SessionDetail struct {
 	Path         string         `gorm:"default:''"`            // 请求路径
 	RequestData  string         `gorm:"type:text;default:''"`  // 请求数据（如 JSON）
 	ResponseData string         `gorm:"type:text;default:''"`  // 响应数据（如 JSON）
-	Input        string         `gorm:"default:''"`
-	Output       string         `gorm:"default:''"`
+	ResponseCode int            `gorm:"not null;default:0"`    // 响应状态码，未发起请求时为 0
+	Error        string         `gorm:"type:text;default:''"`  // 失败原因，如守卫表达式求值错误
+	Attempts     string         `gorm:"type:text;default:''"`  // 请求重试时每次尝试的记录（JSON 数组）
+	Input        string         `gorm:"default:''"` // 本步执行前的会话变量（JSON）
+	Output       string         `gorm:"default:''"` // 本步执行后的会话变量（JSON）
 	DeletedAt    gorm.DeletedAt `gorm:"index"`
 	CreatedAt    time.Time      `gorm:"autoCreateTime:nano"`
 }
 
-func Migrate() {
+// Migrate 同步数据库结构并迁移旧版数据
+func Migrate(db *gorm.DB) error {
 	tables := []any{
 		&SMFlow{},
 		&SMNode{},
 		&SMEdge{},
 		&SMApiKey{},
+		&SMApiKeyAudit{},
+		&SMSecret{},
+		&SMWebhook{},
+		&SMWebhookDelivery{},
 		&SessionInfo{},
 		&SessionDetail{},
+		&SMIdempotencyKey{},
+	}
+	if err := migrateSessionDetails(db); err != nil {
+		return err
 	}
 	for _, table := range tables {
 		if err := db.AutoMigrate(table); err != nil {
-			log.Fatal(err)
+			return err
+		}
+	}
+	return migrateApiKeys(db)
+}
+
+// migrateSessionDetails 会话历史由按 session+node 覆盖改为追加：去掉旧的唯一索引，
+// 并在建立 (session_id, seq) 唯一索引之前按时间顺序为已有记录补齐序号
+func migrateSessionDetails(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&SessionDetail{}) {
+		return nil
+	}
+	if m.HasIndex(&SessionDetail{}, "idx_session_node") {
+		if err := m.DropIndex(&SessionDetail{}, "idx_session_node"); err != nil {
+			return err
+		}
+	}
+	if m.HasColumn(&SessionDetail{}, "Seq") {
+		return nil
+	}
+	if err := m.AddColumn(&SessionDetail{}, "Seq"); err != nil {
+		return err
+	}
+	var rows []SessionDetail
+	if err := db.Unscoped().Select("id", "session_id").Order("session_id, created_at, id").Find(&rows).Error; err != nil {
+		return err
+	}
+	seq := map[int64]int64{}
+	for _, r := range rows {
+		seq[r.SessionID]++
+		if err := db.Unscoped().Model(&SessionDetail{}).Where("id = ?", r.ID).Update("seq", seq[r.SessionID]).Error; err != nil {
+			return err
 		}
 	}
+	return nil
 }
@@ -0,0 +1,107 @@
+package orm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// legacySessionDetail 追加式历史之前的会话历史表：没有 seq 列，按 session+node 唯一
+type legacySessionDetail struct {
+	ID           int64          `gorm:"primaryKey"`
+	SessionID    int64          `gorm:"not null;index:idx_session_node,unique"`
+	NodeID       string         `gorm:"not null;size:128;index:idx_session_node,unique"`
+	SMID         int64          `gorm:"not null"`
+	Event        string         `gorm:"not null;default:''"`
+	FromState    string         `gorm:"not null;default:''"`
+	ToState      string         `gorm:"not null;default:''"`
+	Path         string         `gorm:"default:''"`
+	RequestData  string         `gorm:"type:text;default:''"`
+	ResponseData string         `gorm:"type:text;default:''"`
+	Input        string         `gorm:"default:''"`
+	Output       string         `gorm:"default:''"`
+	DeletedAt    gorm.DeletedAt `gorm:"index"`
+	CreatedAt    time.Time      `gorm:"autoCreateTime:nano"`
+}
+
+func (legacySessionDetail) TableName() string { return "session_details" }
+
+// openLegacy 打开内存数据库并按旧版结构写入会话历史
+func openLegacy(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := conn.AutoMigrate(&legacySessionDetail{}); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 插入顺序与时间顺序不同：补齐序号应按 created_at、id 排序
+	rows := []legacySessionDetail{
+		{ID: 1, SessionID: 1, NodeID: "b", SMID: 1, CreatedAt: base.Add(2 * time.Second)},
+		{ID: 2, SessionID: 2, NodeID: "s", SMID: 1, CreatedAt: base.Add(time.Second)},
+		{ID: 3, SessionID: 1, NodeID: "s", SMID: 1, CreatedAt: base.Add(time.Second)},
+		{ID: 4, SessionID: 1, NodeID: "c", SMID: 1, CreatedAt: base.Add(3 * time.Second)},
+		{ID: 5, SessionID: 2, NodeID: "x", SMID: 1, CreatedAt: base.Add(time.Second)},
+	}
+	if err := conn.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 软删除的记录同样占用序号
+	if err := conn.Delete(&legacySessionDetail{}, 4).Error; err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestMigrateSessionDetailsBackfillsSeq(t *testing.T) {
+	db := openLegacy(t)
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []SessionDetail
+	if err := db.Unscoped().Order("id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]int64{1: 2, 2: 1, 3: 1, 4: 3, 5: 2}
+	for _, r := range rows {
+		if r.Seq != want[r.ID] {
+			t.Errorf("记录 %d（会话 %d）seq=%d，want %d", r.ID, r.SessionID, r.Seq, want[r.ID])
+		}
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("迁移后有 %d 条记录，want %d", len(rows), len(want))
+	}
+
+	m := db.Migrator()
+	if m.HasIndex(&SessionDetail{}, "idx_session_node") {
+		t.Error("旧的 session+node 唯一索引应已删除")
+	}
+	if !m.HasIndex(&SessionDetail{}, "idx_session_seq") {
+		t.Error("应建立 session+seq 唯一索引")
+	}
+	// 同一会话同一节点可以追加多条记录
+	if err := db.Create(&SessionDetail{SessionID: 1, Seq: 4, NodeID: "b", SMID: 1}).Error; err != nil {
+		t.Fatalf("追加同一节点的记录失败: %v", err)
+	}
+
+	// 已迁移的库再次迁移不会改动序号
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var again SessionDetail
+	db.Unscoped().First(&again, 4)
+	if again.Seq != 3 {
+		t.Fatalf("重复迁移后 seq=%d，want 3", again.Seq)
+	}
+}
@@ -4,5 +4,5 @@ import "encoding/json"
 
 func CreateFlow(data string) error {
 	json.Unmarshal([]byte(data), &SMFlow{})
-	return db.Create(&SMFlow{}).Error
+	return DB().Create(&SMFlow{}).Error
 }
@@ -3,8 +3,12 @@ package routers
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/caoaolong/state-server/orm"
@@ -19,18 +23,103 @@ func generateApiKey() string {
 	return apiKeyPrefix + hex.EncodeToString(b)
 }
 
-func maskApiKey(key string) string {
-	if len(key) <= 8 {
-		return "••••••••"
+// maskApiKey 脱敏展示：仅显示查找前缀
+func maskApiKey(row orm.SMApiKey) string {
+	return row.Prefix + "••••••••"
+}
+
+// parseKeyGrants 校验权限范围与状态机 id；未指定权限范围时为 admin
+func parseKeyGrants(scopes, flowIDs []string) ([]string, []int64, error) {
+	if len(scopes) == 0 {
+		scopes = []string{scopeAdmin}
+	}
+	for _, s := range scopes {
+		if !slices.Contains(validScopes, s) {
+			return nil, nil, fmt.Errorf("无效的权限范围 %q，可选值为 %s", s, strings.Join(validScopes, "、"))
+		}
+	}
+	ids := make([]int64, 0, len(flowIDs))
+	for _, s := range flowIDs {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("无效的状态机 id %q", s)
+		}
+		if err := orm.DB().First(&orm.SMFlow{}, id).Error; err != nil {
+			return nil, nil, fmt.Errorf("状态机 %s 不存在", s)
+		}
+		ids = append(ids, id)
+	}
+	return slices.Compact(slices.Sorted(slices.Values(scopes))), ids, nil
+}
+
+func flowIDStrings(ids []int64) []string {
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, strconv.FormatInt(id, 10))
+	}
+	return out
+}
+
+// exceedsGrants 判断权限范围与状态机是否超出当前请求的 API Key，超出时返回原因；未启用鉴权时不限制
+func exceedsGrants(ctx *gin.Context, scopes []string, flowIDs []int64) string {
+	caller := currentApiKey(ctx)
+	if caller == nil {
+		return ""
+	}
+	for _, s := range scopes {
+		if !hasScope(caller, s) {
+			return "当前 API Key 不具备 " + s + " 权限"
+		}
+	}
+	if allowed := allowedFlowIDs(ctx); allowed != nil {
+		if len(flowIDs) == 0 {
+			return "当前 API Key 限定了状态机，目标 Key 也必须限定状态机"
+		}
+		for _, id := range flowIDs {
+			if !slices.Contains(allowed, id) {
+				return "当前 API Key 无权访问状态机 " + strconv.FormatInt(id, 10)
+			}
+		}
 	}
-	return key[:8] + "••••••••"
+	return ""
+}
+
+// manageableKey 当前 API Key 能否管理（查看、刷新、删除）目标 Key：目标的权限范围与状态机须是当前 Key 的子集，
+// 否则受限的 Key 可以借刷新拿到权限更大的 Key 的明文
+func manageableKey(ctx *gin.Context, row orm.SMApiKey) bool {
+	return exceedsGrants(ctx, row.ScopeList(), row.FlowIDList()) == ""
+}
+
+// apiKeyJSON API Key 的返回格式（apiKey 脱敏）
+func apiKeyJSON(r orm.SMApiKey) gin.H {
+	return gin.H{
+		"id":         strconv.FormatInt(r.ID, 10),
+		"name":       r.Name,
+		"prefix":     r.Prefix,
+		"apiKey":     maskApiKey(r),
+		"scopes":     r.ScopeList(),
+		"flowIds":    flowIDStrings(r.FlowIDList()),
+		"expiresAt":  formatTimePtr(r.ExpiresAt),
+		"expired":    r.ExpiresAt != nil && !r.ExpiresAt.After(time.Now()),
+		"lastUsedAt": formatTimePtr(r.LastUsedAt),
+		"usageCount": r.UsageCount,
+		"createdAt":  r.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+}
+
+// formatTimePtr 格式化可为空的时间，为空时返回 nil（JSON null）
+func formatTimePtr(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
 }
 
 func RegisterApiKeyRoutes(r *gin.Engine) {
 	g := r.Group("/api-keys")
 	db := orm.DB()
 
-	// 获取列表（apiKey 返回脱敏）
+	// 获取列表（apiKey 返回脱敏），只列出当前 Key 可管理的 Key
 	g.GET("", func(ctx *gin.Context) {
 		var rows []orm.SMApiKey
 		if err := db.Order("created_at DESC").Find(&rows).Error; err != nil {
@@ -39,12 +128,9 @@ func RegisterApiKeyRoutes(r *gin.Engine) {
 		}
 		list := make([]gin.H, 0, len(rows))
 		for _, r := range rows {
-			list = append(list, gin.H{
-				"id":        strconv.FormatInt(r.ID, 10),
-				"name":      r.Name,
-				"apiKey":    maskApiKey(r.ApiKey),
-				"createdAt": r.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
-			})
+			if manageableKey(ctx, r) {
+				list = append(list, apiKeyJSON(r))
+			}
 		}
 		ctx.JSON(http.StatusOK, gin.H{"list": list})
 	})
@@ -52,7 +138,10 @@ func RegisterApiKeyRoutes(r *gin.Engine) {
 	// 创建
 	g.POST("", func(ctx *gin.Context) {
 		var req struct {
-			Name string `json:"name" binding:"required"`
+			Name    string   `json:"name" binding:"required"`
+			Scopes    []string `json:"scopes"`    // 权限范围，默认 admin
+			FlowIDs   []string `json:"flowIds"`   // 可访问的状态机 id，默认不限制
+			ExpiresAt string   `json:"expiresAt"` // 过期时间（RFC 3339），默认永不过期
 		}
 		if err := ctx.ShouldBindJSON(&req); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
@@ -62,21 +151,47 @@ func RegisterApiKeyRoutes(r *gin.Engine) {
 		if name == "" {
 			name = "未命名"
 		}
+		scopes, flowIDs, err := parseKeyGrants(req.Scopes, req.FlowIDs)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var expiresAt *time.Time
+		if req.ExpiresAt != "" {
+			t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt 格式错误，应为 RFC 3339 时间"})
+				return
+			}
+			if !t.After(time.Now()) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt 必须晚于当前时间"})
+				return
+			}
+			expiresAt = &t
+		}
+		// 不能创建权限超出当前 Key 的 Key
+		if reason := exceedsGrants(ctx, scopes, flowIDs); reason != "" {
+			abortForbidden(ctx, "不能创建权限超出当前 API Key 的 Key："+reason)
+			return
+		}
 		key := generateApiKey()
-		row := orm.SMApiKey{Name: name, ApiKey: key}
+		row := orm.SMApiKey{
+			Name:      name,
+			Scopes:    strings.Join(scopes, ","),
+			FlowIDs:   strings.Join(flowIDStrings(flowIDs), ","),
+			ExpiresAt: expiresAt,
+		}
+		row.SetKey(key)
 		if err := db.Create(&row).Error; err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		ctx.JSON(http.StatusOK, gin.H{
-			"id":        strconv.FormatInt(row.ID, 10),
-			"name":      row.Name,
-			"apiKey":    row.ApiKey,
-			"createdAt": row.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
-		})
+		res := apiKeyJSON(row)
+		res["apiKey"] = key
+		ctx.JSON(http.StatusOK, res)
 	})
 
-	// 刷新（重新生成 Key），仅返回时带完整 apiKey
+	// 刷新（重新生成 Key），仅此次返回完整 apiKey
 	g.PUT("/:id/refresh", func(ctx *gin.Context) {
 		idStr := ctx.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
@@ -89,32 +204,75 @@ func RegisterApiKeyRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "API Key 不存在"})
 			return
 		}
+		if !manageableKey(ctx, row) {
+			abortForbidden(ctx, "不能刷新权限超出当前 API Key 的 Key")
+			return
+		}
 		newKey := generateApiKey()
-		if err := db.Model(&row).Update("api_key", newKey).Error; err != nil {
+		row.SetKey(newKey)
+		if err := db.Model(&row).Updates(map[string]interface{}{
+			"api_key":  "",
+			"prefix":   row.Prefix,
+			"salt":     row.Salt,
+			"key_hash": row.KeyHash,
+		}).Error; err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		db.First(&row, id)
 		ctx.JSON(http.StatusOK, gin.H{
+			"prefix":    row.Prefix,
 			"apiKey":    newKey,
 			"updatedAt": row.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
 		})
 	})
 
-	// 查看完整 Key（用于复制，仅此接口返回明文）
+	// 查看完整 Key：服务端只保存哈希，明文仅在创建/刷新时返回一次
 	g.GET("/:id/reveal", func(ctx *gin.Context) {
-		idStr := ctx.Param("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		ctx.JSON(http.StatusGone, gin.H{"error": "API Key 仅在创建或刷新时显示一次，如已遗失请重新生成"})
+	})
+
+	// 调用审计 GET /api-keys/:id/audit，按时间倒序分页
+	g.GET("/:id/audit", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
-		var row orm.SMApiKey
-		if err := db.First(&row, id).Error; err != nil {
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "API Key 不存在"})
+		var key orm.SMApiKey
+		if err := db.Unscoped().First(&key, id).Error; err == nil && !manageableKey(ctx, key) {
+			abortForbidden(ctx, "不能查看权限超出当前 API Key 的 Key 的审计记录")
+			return
+		}
+		page, _ := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+		pageSize, _ := strconv.Atoi(ctx.DefaultQuery("pageSize", "20"))
+		if page < 1 {
+			page = 1
+		}
+		if pageSize < 1 || pageSize > 100 {
+			pageSize = 20
+		}
+		q := db.Model(&orm.SMApiKeyAudit{}).Where("api_key_id = ?", id)
+		var total int64
+		q.Count(&total)
+		var rows []orm.SMApiKeyAudit
+		if err := q.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&rows).Error; err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		ctx.JSON(http.StatusOK, gin.H{"apiKey": row.ApiKey})
+		list := make([]gin.H, 0, len(rows))
+		for _, r := range rows {
+			list = append(list, gin.H{
+				"id":        strconv.FormatInt(r.ID, 10),
+				"method":    r.Method,
+				"route":     r.Route,
+				"path":      r.Path,
+				"status":    r.Status,
+				"clientIp":  r.ClientIP,
+				"createdAt": r.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+			})
+		}
+		ctx.JSON(http.StatusOK, gin.H{"list": list, "total": total})
 	})
 
 	// 删除
@@ -125,7 +283,16 @@ func RegisterApiKeyRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
-		result := db.Delete(&orm.SMApiKey{}, id)
+		var row orm.SMApiKey
+		if err := db.First(&row, id).Error; err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "API Key 不存在"})
+			return
+		}
+		if !manageableKey(ctx, row) {
+			abortForbidden(ctx, "不能删除权限超出当前 API Key 的 Key")
+			return
+		}
+		result := db.Delete(&row)
 		if result.Error != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
 			return
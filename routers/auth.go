@@ -0,0 +1,328 @@
+package routers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// apiKeyContextKey 鉴权通过后当前 API Key（*orm.SMApiKey）在 gin.Context 中的键
+const apiKeyContextKey = "apiKey"
+
+// API Key 权限范围：admin 包含全部权限，design 包含 read
+const (
+	scopeRead   = "read"   // 查看流程、会话与历史
+	scopeDesign = "design" // 创建、修改、删除流程、节点与密钥
+	scopeRun    = "run"    // 创建会话、投递事件、运行节点、修改会话变量
+	scopeAdmin  = "admin"  // 管理 API Key
+)
+
+// scopeReadOrRun 具备 read 或 run 任一权限即可：实时推送既用于查看会话，也用于接收 run Key 自己投递的事件与运行结果
+const scopeReadOrRun = scopeRead + "|" + scopeRun
+
+// validScopes 可分配给 API Key 的权限范围
+var validScopes = []string{scopeRead, scopeDesign, scopeRun, scopeAdmin}
+
+// routeScopes 路由所需权限，键为 "方法 路由模板"，多个可选权限以 | 分隔；未列出的路由 GET 需要 read，其余需要 design
+var routeScopes = map[string]string{
+	"GET /ws":                                   scopeReadOrRun,
+	"GET /sessions/:id/stream":                  scopeReadOrRun,
+	"POST /sessions":                            scopeRun,
+	"POST /sessions/:id/events":                 scopeRun,
+	"PATCH /sessions/:id/context":               scopeRun,
+	"POST /nodes/run":                           scopeRun,
+	"POST /sessions/:id/suspend":                scopeRun,
+	"POST /sessions/:id/resume":                 scopeRun,
+	"POST /sessions/:id/end":                    scopeRun,
+	"POST /sessions/:id/restart":                scopeRun,
+	"GET /flow/:id/secrets":                     scopeDesign,
+	"GET /flow/:id/webhooks":                    scopeDesign,
+	"GET /flow/:id/webhooks/:hookId/deliveries": scopeDesign,
+	"GET /api-keys":                             scopeAdmin,
+	"POST /api-keys":                            scopeAdmin,
+	"PUT /api-keys/:id/refresh":                 scopeAdmin,
+	"GET /api-keys/:id/reveal":                  scopeAdmin,
+	"GET /api-keys/:id/audit":                   scopeAdmin,
+	"DELETE /api-keys/:id":                      scopeAdmin,
+}
+
+// requiredScope 返回路由所需权限，未匹配到路由时返回空串（交由 404 处理）
+func requiredScope(method, fullPath string) string {
+	if fullPath == "" {
+		return ""
+	}
+	if scope, ok := routeScopes[method+" "+fullPath]; ok {
+		return scope
+	}
+	if method == http.MethodGet {
+		return scopeRead
+	}
+	return scopeDesign
+}
+
+// hasAnyScope Key 是否具备 required（以 | 分隔）中的任一权限
+func hasAnyScope(key *orm.SMApiKey, required string) bool {
+	for _, s := range strings.Split(required, "|") {
+		if hasScope(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScope Key 是否具备所需权限
+func hasScope(key *orm.SMApiKey, required string) bool {
+	for _, s := range key.ScopeList() {
+		if s == required || s == scopeAdmin || (s == scopeDesign && required == scopeRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthConfig 接口鉴权配置
+type AuthConfig struct {
+	Disabled     bool           // 未设置 SM_AUTH=on 时关闭鉴权
+	Bootstrap    bool           // SM_AUTH_BOOTSTRAP=1 时，尚无任何 API Key 的情况下允许匿名创建第一个 Key
+	PublicRoutes []routePattern // 无需鉴权的路由
+}
+
+// routePattern 公开路由：method 为空表示任意方法，prefix 表示按前缀匹配
+type routePattern struct {
+	method string
+	path   string
+	prefix bool
+}
+
+// LoadAuthConfig 从环境变量读取鉴权配置：
+// SM_AUTH=on 开启鉴权（默认关闭，开启前先在设置页保存服务端签发的 Key，否则界面无法访问）；SM_AUTH_BOOTSTRAP=1 允许在尚无 API Key 时匿名创建第一个 Key；SM_PUBLIC_ROUTES 为逗号分隔的公开路由，形如 "GET /flow"、"/docs/*"，
+// 省略方法表示任意方法，以 * 结尾表示前缀匹配
+func LoadAuthConfig() AuthConfig {
+	cfg := AuthConfig{
+		Disabled:  !strings.EqualFold(os.Getenv("SM_AUTH"), "on"),
+		Bootstrap: os.Getenv("SM_AUTH_BOOTSTRAP") == "1",
+	}
+	for _, item := range strings.Split(os.Getenv("SM_PUBLIC_ROUTES"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var p routePattern
+		if method, path, ok := strings.Cut(item, " "); ok {
+			p.method, item = strings.ToUpper(method), strings.TrimSpace(path)
+		}
+		if strings.HasSuffix(item, "*") {
+			p.prefix, item = true, strings.TrimSuffix(item, "*")
+		}
+		p.path = item
+		cfg.PublicRoutes = append(cfg.PublicRoutes, p)
+	}
+	return cfg
+}
+
+func (p routePattern) match(method, path string) bool {
+	if p.method != "" && p.method != method {
+		return false
+	}
+	if p.prefix {
+		return strings.HasPrefix(path, p.path)
+	}
+	return path == p.path
+}
+
+// isPublic 按请求路径或路由模板（如 /flow/:id）匹配公开路由
+func (cfg AuthConfig) isPublic(ctx *gin.Context) bool {
+	method := ctx.Request.Method
+	for _, p := range cfg.PublicRoutes {
+		if p.match(method, ctx.Request.URL.Path) || p.match(method, ctx.FullPath()) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyAuth API Key 鉴权中间件：从 Authorization: Bearer <key> 或 X-API-Key 取出 Key，按前缀查找 SMApiKey 后校验哈希，
+// 浏览器无法为 WebSocket 握手与 EventSource 设置请求头，这两类请求也可以用 ?apiKey= 传递。
+// 缺少、格式错误、无效或已过期的 Key 一律返回 401 与 WWW-Authenticate；Key 有效但缺少路由所需权限时返回 403，
+// 状态机范围由各处理函数通过 allowFlow/allowSession/scopeFlows 校验。
+// 尚未创建任何 API Key 时拒绝全部请求；设置了 SM_AUTH_BOOTSTRAP=1 时仅放行 POST /api-keys 以创建第一个 Key
+func APIKeyAuth(cfg AuthConfig) gin.HandlerFunc {
+	if cfg.Disabled {
+		log.Println("API Key 鉴权未开启，设置 SM_AUTH=on 开启")
+	} else if cfg.Bootstrap {
+		log.Println("尚无 API Key 时允许匿名创建第一个 Key（SM_AUTH_BOOTSTRAP=1），创建后请移除该配置")
+	}
+	return func(ctx *gin.Context) {
+		if cfg.Disabled || ctx.Request.Method == http.MethodOptions || cfg.isPublic(ctx) {
+			ctx.Next()
+			return
+		}
+		db := orm.DB()
+		var count int64
+		if err := db.Model(&orm.SMApiKey{}).Count(&count).Error; err != nil {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count == 0 {
+			if cfg.Bootstrap && ctx.Request.Method == http.MethodPost && ctx.FullPath() == "/api-keys" {
+				ctx.Next()
+				return
+			}
+			abortUnauthorized(ctx, "尚未创建 API Key：设置 SM_AUTH_BOOTSTRAP=1 后通过 POST /api-keys 创建第一个 Key，或去掉 SM_AUTH=on 关闭鉴权")
+			return
+		}
+		key, err := apiKeyFromRequest(ctx.Request)
+		if err != "" {
+			abortUnauthorized(ctx, err)
+			return
+		}
+		row := findApiKey(key)
+		if row == nil {
+			abortUnauthorized(ctx, "API Key 无效")
+			return
+		}
+		expired := row.ExpiresAt != nil && !row.ExpiresAt.After(time.Now())
+		defer recordUsage(ctx, row, !expired)
+		if expired {
+			abortUnauthorized(ctx, "API Key 已过期")
+			return
+		}
+		if scope := requiredScope(ctx.Request.Method, ctx.FullPath()); scope != "" && !hasAnyScope(row, scope) {
+			abortForbidden(ctx, "API Key 缺少 "+strings.ReplaceAll(scope, "|", " 或 ")+" 权限")
+			return
+		}
+		ctx.Set(apiKeyContextKey, row)
+		ctx.Next()
+	}
+}
+
+// recordUsage 写入调用审计；Key 未过期时累加使用次数并更新最近使用时间
+func recordUsage(ctx *gin.Context, key *orm.SMApiKey, authenticated bool) {
+	db := orm.DB()
+	audit := orm.SMApiKeyAudit{
+		ApiKeyID: key.ID,
+		Method:   ctx.Request.Method,
+		Route:    ctx.FullPath(),
+		Path:     ctx.Request.URL.Path,
+		Status:   ctx.Writer.Status(),
+		ClientIP: ctx.ClientIP(),
+	}
+	if err := db.Create(&audit).Error; err != nil {
+		log.Println("写入 API Key 审计失败:", err)
+	}
+	if authenticated {
+		db.Model(&orm.SMApiKey{}).Where("id = ?", key.ID).UpdateColumns(map[string]interface{}{
+			"usage_count":  gorm.Expr("usage_count + 1"),
+			"last_used_at": time.Now(),
+		})
+	}
+}
+
+// currentApiKey 返回本次请求鉴权通过的 API Key，未启用鉴权或处于初始化阶段时返回 nil
+func currentApiKey(ctx *gin.Context) *orm.SMApiKey {
+	v, ok := ctx.Get(apiKeyContextKey)
+	if !ok {
+		return nil
+	}
+	key, _ := v.(*orm.SMApiKey)
+	return key
+}
+
+// allowedFlowIDs 返回当前 Key 可访问的状态机 id，nil 表示不限制
+func allowedFlowIDs(ctx *gin.Context) []int64 {
+	key := currentApiKey(ctx)
+	if key == nil {
+		return nil
+	}
+	ids := key.FlowIDList()
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// allowFlow 校验当前 Key 能否访问状态机 smID，不能访问时写入 403 并返回 false
+func allowFlow(ctx *gin.Context, smID int64) bool {
+	ids := allowedFlowIDs(ctx)
+	if ids == nil {
+		return true
+	}
+	if slices.Contains(ids, smID) {
+		return true
+	}
+	abortForbidden(ctx, "API Key 无权访问该状态机")
+	return false
+}
+
+// allowSession 校验当前 Key 能否访问会话所属的状态机；会话不存在时放行，由处理函数返回 404
+func allowSession(ctx *gin.Context, sessionID int64) bool {
+	if allowedFlowIDs(ctx) == nil {
+		return true
+	}
+	var s orm.SessionInfo
+	if err := orm.DB().Select("sm_id").First(&s, sessionID).Error; err != nil {
+		return true
+	}
+	return allowFlow(ctx, s.SMID)
+}
+
+// scopeFlows 按当前 Key 可访问的状态机过滤查询，column 为状态机 id 列名
+func scopeFlows(ctx *gin.Context, q *gorm.DB, column string) *gorm.DB {
+	if ids := allowedFlowIDs(ctx); ids != nil {
+		return q.Where(column+" IN ?", ids)
+	}
+	return q
+}
+
+// findApiKey 按查找前缀取出候选记录，再逐个比对哈希
+func findApiKey(key string) *orm.SMApiKey {
+	var rows []orm.SMApiKey
+	if orm.DB().Where("prefix = ?", orm.ApiKeyPrefix(key)).Find(&rows).Error != nil {
+		return nil
+	}
+	for i := range rows {
+		if rows[i].Verify(key) {
+			return &rows[i]
+		}
+	}
+	return nil
+}
+
+// apiKeyFromRequest 取出请求携带的 API Key，失败时返回错误说明
+func apiKeyFromRequest(r *http.Request) (string, string) {
+	if auth := strings.TrimSpace(r.Header.Get("Authorization")); auth != "" {
+		scheme, key, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(key) == "" {
+			return "", "Authorization 请求头格式错误，应为 Bearer <API Key>"
+		}
+		return strings.TrimSpace(key), ""
+	}
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key, ""
+	}
+	// 浏览器的 WebSocket 与 EventSource 无法设置请求头，允许通过查询参数传递
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		if key := r.URL.Query().Get("apiKey"); key != "" {
+			return key, ""
+		}
+	}
+	return "", "缺少 API Key"
+}
+
+// abortUnauthorized 未认证：返回 401 并提示使用 Bearer 认证
+func abortUnauthorized(ctx *gin.Context, msg string) {
+	ctx.Header("WWW-Authenticate", `Bearer realm="state-server"`)
+	ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+}
+
+// abortForbidden 已认证但无权访问：返回 403
+func abortForbidden(ctx *gin.Context, msg string) {
+	ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": msg})
+}
@@ -0,0 +1,16 @@
+package routers
+
+import (
+	"net/http"
+
+	"github.com/caoaolong/state-server/engine"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterEngineRoutes 引擎运行指标
+func RegisterEngineRoutes(r *gin.Engine) {
+	// 会话执行队列指标 GET /engine/queue：排队深度、执行中的任务数、活跃会话数与累计执行、拒绝、放弃的任务数
+	r.GET("/engine/queue", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, engine.Default().Queue().Stats())
+	})
+}
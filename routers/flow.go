@@ -2,11 +2,15 @@ package routers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/caoaolong/state-server/engine"
+	"github.com/caoaolong/state-server/expr"
 	"github.com/caoaolong/state-server/orm"
 	"gorm.io/gorm"
 )
@@ -36,9 +40,21 @@ type positionPayload struct {
 }
 
 type edgePayload struct {
-	ID     string `json:"id"`
-	Source string `json:"source"`
-	Target string `json:"target"`
+	ID           string           `json:"id"`
+	Source       string           `json:"source"`
+	Target       string           `json:"target"`
+	SourceHandle string           `json:"sourceHandle"`
+	TargetHandle string           `json:"targetHandle"`
+	Label        string           `json:"label"`
+	Data         *edgeDataPayload `json:"data,omitempty"`
+}
+
+// edgeDataPayload 边 data 中与迁移相关的字段
+type edgeDataPayload struct {
+	Event    string `json:"event"`
+	Label    string `json:"label"`
+	Priority int    `json:"priority"`
+	Guard    string `json:"guard"`
 }
 
 // 列表/详情返回用（BaseURL 对应前端 baseUrl）
@@ -68,7 +84,7 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 		}
 
 		var list []orm.SMFlow
-		q := db.Model(&orm.SMFlow{})
+		q := scopeFlows(ctx, db.Model(&orm.SMFlow{}), "id")
 		if keyword != "" {
 			q = q.Where("name LIKE ? OR description LIKE ?", "%"+keyword+"%", "%"+keyword+"%")
 		}
@@ -96,6 +112,10 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 
 	// 创建状态机（事务）
 	g.POST("", func(ctx *gin.Context) {
+		if allowedFlowIDs(ctx) != nil {
+			abortForbidden(ctx, "API Key 限定了可访问的状态机，不能创建新的状态机")
+			return
+		}
 		var req createStateMachineReq
 		if err := ctx.ShouldBindJSON(&req); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
@@ -135,6 +155,9 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
+		if !allowFlow(ctx, id) {
+			return
+		}
 		var flow orm.SMFlow
 		if err := db.First(&flow, id).Error; err != nil {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
@@ -152,6 +175,9 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
+		if !allowFlow(ctx, id) {
+			return
+		}
 		var flow orm.SMFlow
 		if err := db.First(&flow, id).Error; err != nil {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
@@ -164,6 +190,10 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			"description": flow.Description,
 			"baseUrl":     flow.BaseURL,
 			"identifier":  flow.Identifier,
+			"constants":   engine.DecodeConstants(&flow),
+			"http":        flowHTTPOptions(&flow),
+			"headers":     flowHeaders(&flow),
+			"auth":        flowAuth(&flow),
 			"createdAt":   flow.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
 			"updatedAt":   flow.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
 			"flowData":    gin.H{"nodes": nodes, "edges": edges},
@@ -178,6 +208,9 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
+		if !allowFlow(ctx, id) {
+			return
+		}
 		var flow orm.SMFlow
 		if err := db.First(&flow, id).Error; err != nil {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
@@ -201,6 +234,17 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 				tx.Rollback()
 			}
 		}()
+		// 原有节点的认证配置，提交的脱敏凭据按节点 id 还原
+		var prevNodes []orm.SMNode
+		if err := tx.Select("node_id", "auth").Where("sm_id = ?", id).Find(&prevNodes).Error; err != nil {
+			tx.Rollback()
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		prevAuth := make(map[string]string, len(prevNodes))
+		for _, p := range prevNodes {
+			prevAuth[p.NodeID] = p.Auth
+		}
 		// 物理删除该状态机下原有节点与边，再重新插入（避免软删导致表内记录只增不减）
 		if err := tx.Unscoped().Where("sm_id = ?", id).Delete(&orm.SMNode{}).Error; err != nil {
 			tx.Rollback()
@@ -220,6 +264,12 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 				storeBytes = []byte("{}")
 			}
 			reqPath, reqMethod, reqData := getRequestFieldsFromData(n.Data)
+			cfg, err := validateNodeConfig(n.Data, prevAuth[n.ID])
+			if err != nil {
+				tx.Rollback()
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "节点 " + n.ID + ": " + err.Error()})
+				return
+			}
 			node := orm.SMNode{
 				SMID:          id,
 				NodeID:        n.ID,
@@ -229,6 +279,10 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 				RequestPath:   reqPath,
 				RequestMethod: reqMethod,
 				RequestData:   reqData,
+				Extract:       cfg.Extract,
+				HTTPOptions:   cfg.HTTPOptions,
+				Headers:       cfg.Headers,
+				Auth:          cfg.Auth,
 			}
 			if node.Type == "" {
 				node.Type = "default"
@@ -239,13 +293,19 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 				return
 			}
 		}
-		// 写入边
+		// 写入边（选择节点的出边按 sourceHandle 对应到选项）
+		nodeData := make(map[string]json.RawMessage, len(req.Nodes))
+		for _, n := range req.Nodes {
+			nodeData[n.ID] = n.Data
+		}
 		for _, e := range req.Edges {
-			edge := orm.SMEdge{
-				SMID:       id,
-				EdgeID:     e.ID,
-				FromNodeID: e.Source,
-				ToNodeID:   e.Target,
+			edge := edgeFromPayload(id, e, nodeData[e.Source])
+			if edge.Guard != "" {
+				if _, err := expr.Compile(edge.Guard); err != nil {
+					tx.Rollback()
+					ctx.JSON(http.StatusBadRequest, gin.H{"error": "边 " + e.ID + " 的守卫条件错误: " + err.Error()})
+					return
+				}
 			}
 			if err := tx.Create(&edge).Error; err != nil {
 				tx.Rollback()
@@ -281,16 +341,23 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
+		if !allowFlow(ctx, id) {
+			return
+		}
 		var flow orm.SMFlow
 		if err := db.First(&flow, id).Error; err != nil {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
 			return
 		}
 		var req struct {
-			Name        *string `json:"name"`
-			Description *string `json:"description"`
-			BaseURL     *string `json:"baseUrl"`
-			Identifier  *string `json:"identifier"`
+			Name        *string         `json:"name"`
+			Description *string         `json:"description"`
+			BaseURL     *string         `json:"baseUrl"`
+			Identifier  *string         `json:"identifier"`
+			Constants   *map[string]any `json:"constants"` // 流程常量，整体替换
+			HTTP        json.RawMessage `json:"http"`      // HTTP 客户端配置，整体替换
+			Headers     json.RawMessage `json:"headers"`   // 默认请求头，整体替换
+			Auth        json.RawMessage `json:"auth"`      // 默认认证方式，整体替换
 		}
 		if err := ctx.ShouldBindJSON(&req); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "请求体格式错误"})
@@ -309,6 +376,33 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 		if req.Identifier != nil {
 			updates["identifier"] = *req.Identifier
 		}
+		if req.Constants != nil {
+			updates["constants"] = engine.EncodeContext(*req.Constants)
+		}
+		if req.HTTP != nil {
+			httpOptions, err := encodeHTTPOptions(req.HTTP)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			updates["http_options"] = httpOptions
+		}
+		if req.Headers != nil {
+			headers, err := encodeHeaders(req.Headers)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			updates["headers"] = headers
+		}
+		if req.Auth != nil {
+			auth, err := encodeAuth(req.Auth, flow.Auth)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			updates["auth"] = auth
+		}
 		if len(updates) > 0 {
 			if err := db.Model(&flow).Updates(updates).Error; err != nil {
 				ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -321,6 +415,10 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			"name":        flow.Name,
 			"description": flow.Description,
 			"baseUrl":     flow.BaseURL,
+			"constants":   engine.DecodeConstants(&flow),
+			"http":        flowHTTPOptions(&flow),
+			"headers":     flowHeaders(&flow),
+			"auth":        flowAuth(&flow),
 			"updatedAt":   flow.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
 		})
 	})
@@ -333,6 +431,9 @@ func RegisterStateMachineRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
+		if !allowFlow(ctx, id) {
+			return
+		}
 		tx := db.Begin()
 		defer func() {
 			if r := recover(); r != nil {
@@ -390,6 +491,20 @@ func loadFlowData(db *gorm.DB, smID int64) (nodes []map[string]any, edges []map[
 		if r.RequestData != "" {
 			dataObj["requestData"] = r.RequestData
 		}
+		if rules, err := engine.ParseExtractRules(r.Extract); err == nil && len(rules) > 0 {
+			dataObj["extract"] = rules
+		}
+		if opts, err := engine.ParseHTTPOptions(r.HTTPOptions); err == nil && r.HTTPOptions != "" {
+			dataObj["http"] = opts
+		}
+		if headers, err := engine.ParseHeaders(r.Headers); err == nil && len(headers) > 0 {
+			dataObj["headers"] = headers
+		}
+		if auth, err := engine.ParseAuth(r.Auth); err == nil && auth != nil {
+			dataObj["auth"] = auth.Masked()
+		} else {
+			delete(dataObj, "auth")
+		}
 		nodes = append(nodes, map[string]any{
 			"id":       r.NodeID,
 			"type":     r.Type,
@@ -401,15 +516,83 @@ func loadFlowData(db *gorm.DB, smID int64) (nodes []map[string]any, edges []map[
 	db.Where("sm_id = ?", smID).Find(&edgeRows)
 	edges = make([]map[string]any, 0, len(edgeRows))
 	for _, r := range edgeRows {
-		edges = append(edges, map[string]any{
+		edge := map[string]any{
 			"id":     r.EdgeID,
 			"source": r.FromNodeID,
 			"target": r.ToNodeID,
-		})
+			"data": map[string]any{
+				"event":    r.Event,
+				"label":    r.Label,
+				"priority": r.Priority,
+				"guard":    r.Guard,
+			},
+		}
+		if r.SourceHandle != "" {
+			edge["sourceHandle"] = r.SourceHandle
+		}
+		if r.TargetHandle != "" {
+			edge["targetHandle"] = r.TargetHandle
+		}
+		if r.Label != "" {
+			edge["label"] = r.Label
+		}
+		edges = append(edges, edge)
 	}
 	return nodes, edges
 }
 
+// edgeFromPayload 将前端边转换为 SMEdge；未显式指定事件时，选择节点的出边按 sourceHandle（source-i）取第 i 个选项的 label
+func edgeFromPayload(smID int64, e edgePayload, sourceData json.RawMessage) orm.SMEdge {
+	edge := orm.SMEdge{
+		SMID:         smID,
+		EdgeID:       e.ID,
+		FromNodeID:   e.Source,
+		ToNodeID:     e.Target,
+		SourceHandle: e.SourceHandle,
+		TargetHandle: e.TargetHandle,
+		Label:        e.Label,
+	}
+	if e.Data != nil {
+		edge.Event = strings.TrimSpace(e.Data.Event)
+		edge.Priority = e.Data.Priority
+		edge.Guard = strings.TrimSpace(e.Data.Guard)
+		if e.Data.Label != "" {
+			edge.Label = e.Data.Label
+		}
+	}
+	if edge.Event == "" {
+		if option := getChoiceOptionLabel(sourceData, e.SourceHandle); option != "" {
+			edge.Event = option
+			if edge.Label == "" {
+				edge.Label = option
+			}
+		}
+	}
+	return edge
+}
+
+// getChoiceOptionLabel 选择节点按 handle（source-i）取出第 i 个选项的 label
+func getChoiceOptionLabel(data json.RawMessage, handle string) string {
+	idx, ok := strings.CutPrefix(handle, "source-")
+	if !ok {
+		return ""
+	}
+	i, err := strconv.Atoi(idx)
+	if err != nil || i < 0 {
+		return ""
+	}
+	var m struct {
+		NodeCategory string `json:"nodeCategory"`
+		Options      []struct {
+			Label string `json:"label"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil || m.NodeCategory != "choice" || i >= len(m.Options) {
+		return ""
+	}
+	return strings.TrimSpace(m.Options[i].Label)
+}
+
 // getLabelFromData 从 data JSON 中取出 label
 func getLabelFromData(data json.RawMessage) string {
 	var m map[string]any
@@ -439,3 +622,151 @@ func getRequestFieldsFromData(data json.RawMessage) (path, method, dataStr strin
 	}
 	return path, method, dataStr
 }
+
+// nodeConfig 节点 data 中经过校验、单独存列的出站请求配置（均为序列化后的 JSON，未配置时为空串）
+type nodeConfig struct {
+	Extract     string
+	HTTPOptions string
+	Headers     string
+	Auth        string
+}
+
+// validateNodeConfig 校验节点 data 中的提取规则、HTTP 客户端配置、请求头与认证方式并序列化，
+// 保存整个流程与单个节点时共用；storedAuth 为节点已保存的认证配置，提交的脱敏凭据按它还原
+func validateNodeConfig(data json.RawMessage, storedAuth string) (cfg nodeConfig, err error) {
+	if cfg.Extract, err = getExtractFromData(data); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPOptions, err = getHTTPOptionsFromData(data); err != nil {
+		return cfg, err
+	}
+	cfg.Headers, cfg.Auth, err = getHeadersAuthFromData(data, storedAuth)
+	return cfg, err
+}
+
+// getExtractFromData 从 data JSON 中取出 extract（响应提取规则数组），校验后序列化为字符串
+func getExtractFromData(data json.RawMessage) (string, error) {
+	var m struct {
+		Extract []engine.ExtractRule `json:"extract"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil || len(m.Extract) == 0 {
+		return "", nil
+	}
+	for i, rule := range m.Extract {
+		if strings.TrimSpace(rule.Var) == "" {
+			return "", fmt.Errorf("第 %d 条提取规则缺少 var", i+1)
+		}
+		if rule.Source == "" {
+			m.Extract[i].Source = "body"
+		}
+		if rule.Var == engine.MergeVar && rule.Source != "" && rule.Source != "body" {
+			return "", fmt.Errorf("第 %d 条提取规则: var 为 * 时只能从 body 提取", i+1)
+		}
+		switch rule.Source {
+		case "", "body", "status":
+		case "header":
+			if rule.Name == "" {
+				return "", fmt.Errorf("第 %d 条提取规则缺少响应头 name", i+1)
+			}
+		default:
+			return "", fmt.Errorf("第 %d 条提取规则的 source 无效: %s", i+1, rule.Source)
+		}
+	}
+	b, _ := json.Marshal(m.Extract)
+	return string(b), nil
+}
+
+// getHTTPOptionsFromData 从 data JSON 中取出 http（节点级 HTTP 客户端配置），校验后序列化为字符串
+func getHTTPOptionsFromData(data json.RawMessage) (string, error) {
+	var m struct {
+		HTTP json.RawMessage `json:"http"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil || len(m.HTTP) == 0 || string(m.HTTP) == "null" {
+		return "", nil
+	}
+	return encodeHTTPOptions(m.HTTP)
+}
+
+// encodeHTTPOptions 校验 HTTP 客户端配置并序列化，未设置任何项时返回空串
+func encodeHTTPOptions(raw json.RawMessage) (string, error) {
+	opts, err := engine.ParseHTTPOptions(string(raw))
+	if err != nil {
+		return "", err
+	}
+	b, _ := json.Marshal(opts)
+	if string(b) == "{}" {
+		return "", nil
+	}
+	return string(b), nil
+}
+
+// flowHTTPOptions 返回流程级 HTTP 客户端配置，未配置时返回空对象
+func flowHTTPOptions(flow *orm.SMFlow) engine.HTTPOptions {
+	opts, _ := engine.ParseHTTPOptions(flow.HTTPOptions)
+	return opts
+}
+
+// getHeadersAuthFromData 从 data JSON 中取出 headers（请求头数组）与 auth（认证方式），校验后序列化为字符串；
+// storedAuth 为节点已保存的认证配置，提交的脱敏凭据按它还原
+func getHeadersAuthFromData(data json.RawMessage, storedAuth string) (headers, auth string, err error) {
+	var m struct {
+		Headers json.RawMessage `json:"headers"`
+		Auth    json.RawMessage `json:"auth"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", "", nil
+	}
+	if headers, err = encodeHeaders(m.Headers); err != nil {
+		return "", "", err
+	}
+	if auth, err = encodeAuth(m.Auth, storedAuth); err != nil {
+		return "", "", err
+	}
+	return headers, auth, nil
+}
+
+// encodeHeaders 校验请求头配置并序列化，为空时返回空串
+func encodeHeaders(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	headers, err := engine.ParseHeaders(string(raw))
+	if err != nil || len(headers) == 0 {
+		return "", err
+	}
+	b, _ := json.Marshal(headers)
+	return string(b), nil
+}
+
+// encodeAuth 校验认证配置并序列化，未配置认证方式时返回空串；
+// 读取接口返回的是脱敏凭据，原样提交的 MaskedCredential 沿用 stored 中已保存的值
+func encodeAuth(raw json.RawMessage, stored string) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	auth, err := engine.ParseAuth(string(raw))
+	if err != nil || auth == nil {
+		return "", err
+	}
+	prev, _ := engine.ParseAuth(stored)
+	if err := auth.KeepMasked(prev); err != nil {
+		return "", err
+	}
+	b, _ := json.Marshal(auth)
+	return string(b), nil
+}
+
+// flowHeaders 返回流程级默认请求头，未配置时返回空数组
+func flowHeaders(flow *orm.SMFlow) []engine.Header {
+	headers, _ := engine.ParseHeaders(flow.Headers)
+	if headers == nil {
+		headers = []engine.Header{}
+	}
+	return headers
+}
+
+// flowAuth 返回流程级认证方式（凭据已脱敏），未配置时返回 null
+func flowAuth(flow *orm.SMFlow) *engine.Auth {
+	auth, _ := engine.ParseAuth(flow.Auth)
+	return auth.Masked()
+}
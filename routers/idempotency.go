@@ -0,0 +1,148 @@
+package routers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	idempotencyHeader      = "Idempotency-Key"
+	idempotencyMaxKey      = 255
+	idempotencyLockTimeout = 5 * time.Minute // 处理中的记录超过该时长未续期视为进程中断，允许重新执行
+	idempotencyHeartbeat   = time.Minute     // 执行期间续期处理中记录的间隔，远小于 idempotencyLockTimeout
+)
+
+// idempotencyWindow 首个请求结果的保留时长，由 SM_IDEMPOTENCY_TTL 配置（默认 24h）
+var idempotencyWindow = func() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SM_IDEMPOTENCY_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}()
+
+// idempotent 以幂等键执行 run：同一作用域内同一个键的首个请求正常执行并保存结果，
+// 有效期内的重复请求不再执行，直接返回保存的状态码与响应体（replayed=true）。
+// 只有未开始执行就失败的结果（队列已满、版本冲突）不保存，删除记录后可用同一个键重试；
+// 上游失败等执行后的错误可能已产生副作用，与成功结果一样保存并重放。
+// 带键时 run 使用不随客户端断开而取消的 ctx，保证首次执行能完成并保存真实结果；
+// 执行期间定期续期记录，排队与重试耗时再长也不会被重复请求当作中断接手。
+// 首个请求仍在处理时返回 409；同一个键用于内容不同的请求时返回 422。key 为空时直接执行
+func idempotent(ctx context.Context, key, scope string, request any, run func(ctx context.Context) (int, any)) (code int, body []byte, replayed bool) {
+	if key == "" {
+		code, res := run(ctx)
+		body, _ = json.Marshal(res)
+		return code, body, false
+	}
+	if len(key) > idempotencyMaxKey {
+		return idempotencyError(http.StatusBadRequest, "Idempotency-Key 不能超过 255 个字符")
+	}
+	raw, _ := json.Marshal(request)
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+
+	db := orm.DB()
+	var row orm.SMIdempotencyKey
+	conflict, reason := 0, ""
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Where("expires_at < ?", now).Delete(&orm.SMIdempotencyKey{}).Error; err != nil {
+			return err
+		}
+		err := tx.Where(&orm.SMIdempotencyKey{Scope: scope, Key: key}).First(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			row = orm.SMIdempotencyKey{Scope: scope, Key: key, RequestHash: hash, Status: "processing", ExpiresAt: now.Add(idempotencyWindow)}
+			return tx.Create(&row).Error
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case row.RequestHash != hash:
+			conflict, reason = http.StatusUnprocessableEntity, "Idempotency-Key 已用于内容不同的请求"
+		case row.Status == "done":
+		case now.Sub(row.UpdatedAt) < idempotencyLockTimeout:
+			conflict, reason = http.StatusConflict, "相同 Idempotency-Key 的请求正在处理中"
+		default:
+			// 上次执行未完成（如进程中断），由本次请求接手
+			return tx.Model(&row).Update("updated_at", now).Error
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		return idempotencyError(http.StatusInternalServerError, err.Error())
+	case conflict != 0:
+		return idempotencyError(conflict, reason)
+	case row.Status == "done":
+		return row.ResponseCode, []byte(row.ResponseBody), true
+	}
+
+	stop := keepProcessing(db, row.ID)
+	code, res := run(context.WithoutCancel(ctx))
+	stop()
+	body, _ = json.Marshal(res)
+	if retryable(code) {
+		db.Delete(&row)
+		return code, body, false
+	}
+	db.Model(&row).Updates(map[string]interface{}{
+		"status":        "done",
+		"response_code": code,
+		"response_body": string(body),
+		"expires_at":    time.Now().Add(idempotencyWindow),
+	})
+	return code, body, false
+}
+
+// retryable 结果是否可重试：队列已满（503）与版本冲突（409）发生在执行之前，重试时可能成功
+func retryable(code int) bool {
+	return code == http.StatusServiceUnavailable || code == http.StatusConflict
+}
+
+// keepProcessing 每隔 idempotencyHeartbeat 续期处理中的记录，返回的 stop 停止续期并等待续期协程退出
+func keepProcessing(db *gorm.DB, id int64) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(idempotencyHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				db.Model(&orm.SMIdempotencyKey{}).Where("id = ? AND status = ?", id, "processing").Update("updated_at", time.Now())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func idempotencyError(code int, msg string) (int, []byte, bool) {
+	body, _ := json.Marshal(gin.H{"error": msg})
+	return code, body, false
+}
+
+// writeIdempotent 写出 idempotent 的结果，重放的响应带 Idempotent-Replayed: true
+func writeIdempotent(ctx *gin.Context, code int, body []byte, replayed bool) {
+	if replayed {
+		ctx.Header("Idempotent-Replayed", "true")
+	}
+	ctx.Data(code, "application/json; charset=utf-8", body)
+}
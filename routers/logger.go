@@ -0,0 +1,56 @@
+package routers
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sensitiveQuery 请求日志中需要脱敏的查询参数
+var sensitiveQuery = []string{"apiKey"}
+
+// Logger 请求日志中间件，格式与 gin.Logger 一致，但会脱敏查询参数中的 API Key
+// （WebSocket 与 EventSource 请求可以通过 ?apiKey= 传递 Key）
+func Logger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if p.IsOutputColor() {
+			statusColor, methodColor, resetColor = p.StatusCodeColor(), p.MethodColor(), p.ResetColor()
+		}
+		if p.Latency > time.Minute {
+			p.Latency = p.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, p.StatusCode, resetColor,
+			p.Latency,
+			p.ClientIP,
+			methodColor, p.Method, resetColor,
+			redactPath(p.Path),
+			p.ErrorMessage,
+		)
+	})
+}
+
+// redactPath 将路径中敏感查询参数的值替换为 REDACTED
+func redactPath(path string) string {
+	u, err := url.Parse(path)
+	if err != nil {
+		return path
+	}
+	q := u.Query()
+	redacted := false
+	for _, name := range sensitiveQuery {
+		if q.Has(name) {
+			q.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return path
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
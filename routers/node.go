@@ -1,21 +1,24 @@
 package routers
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/caoaolong/state-server/engine"
 	"github.com/caoaolong/state-server/orm"
 )
 
-// RunNodeRequest 运行节点请求：Node + 可选 sessionId（默认 0，设计页固定为 0）
+// RunNodeRequest 运行节点请求：状态机 id + Node + 可选 sessionId（默认 0，设计页固定为 0）
 type RunNodeRequest struct {
-	Node      RunNodePayload `json:"node" binding:"required"`
-	SessionID int64          `json:"sessionId"` // 逻辑会话 id，0 表示设计页会话
+	StateMachineID  string         `json:"stateMachineId"` // 节点所属状态机，节点 id 只在状态机内唯一
+	Node            RunNodePayload `json:"node" binding:"required"`
+	SessionID       int64          `json:"sessionId"`       // 逻辑会话 id，0 表示设计页会话
+	ExpectedVersion int64          `json:"expectedVersion"` // 可选：期望的会话版本，也可用 If-Match 请求头
 }
 
 // RunNodePayload 节点结构（与前端/流程中的节点一致）
@@ -38,6 +41,7 @@ type RunNodeResponse struct {
 	OK         bool   `json:"ok"`
 	StatusCode int    `json:"statusCode"`
 	Body       string `json:"body"`
+	Version    int64  `json:"version,omitempty"` // 运行后的会话版本
 	Error      string `json:"error,omitempty"`
 }
 
@@ -62,6 +66,9 @@ func putFlowNode(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的状态机 id"})
 		return
 	}
+	if !allowFlow(c, id) {
+		return
+	}
 	db := orm.DB()
 	if err := db.First(&orm.SMFlow{}, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
@@ -80,6 +87,13 @@ func putFlowNode(c *gin.Context) {
 		storeBytes = []byte("{}")
 	}
 	reqPath, reqMethod, reqData := getRequestFieldsFromData(req.Data)
+	var stored orm.SMNode
+	db.Select("auth").Where("sm_id = ? AND node_id = ?", id, nodeID).First(&stored)
+	cfg, err := validateNodeConfig(req.Data, stored.Auth)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	label := getLabelFromData(req.Data)
 	result := db.Model(&orm.SMNode{}).Where("sm_id = ? AND node_id = ?", id, nodeID).Updates(map[string]interface{}{
 		"type":           req.Type,
@@ -88,6 +102,10 @@ func putFlowNode(c *gin.Context) {
 		"request_path":   reqPath,
 		"request_method": reqMethod,
 		"request_data":   reqData,
+		"extract":        cfg.Extract,
+		"http_options":   cfg.HTTPOptions,
+		"headers":        cfg.Headers,
+		"auth":           cfg.Auth,
 	})
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
@@ -108,6 +126,9 @@ func postFlowNode(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的状态机 id"})
 		return
 	}
+	if !allowFlow(c, id) {
+		return
+	}
 	db := orm.DB()
 	if err := db.First(&orm.SMFlow{}, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
@@ -123,8 +144,13 @@ func postFlowNode(c *gin.Context) {
 		return
 	}
 	var existing orm.SMNode
-	err = db.Where("sm_id = ? AND node_id = ?", id, req.ID).First(&existing).Error
-	if err == nil {
+	found := db.Where("sm_id = ? AND node_id = ?", id, req.ID).First(&existing).Error == nil
+	cfg, err := validateNodeConfig(req.Data, existing.Auth)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if found {
 		storeBytes, _ := json.Marshal(map[string]any{"position": req.Position, "data": req.Data})
 		if len(storeBytes) <= 2 {
 			storeBytes = []byte("{}")
@@ -138,6 +164,10 @@ func postFlowNode(c *gin.Context) {
 			"request_path":   reqPath,
 			"request_method": reqMethod,
 			"request_data":   reqData,
+			"extract":        cfg.Extract,
+			"http_options":   cfg.HTTPOptions,
+			"headers":        cfg.Headers,
+			"auth":           cfg.Auth,
 		}).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -159,6 +189,10 @@ func postFlowNode(c *gin.Context) {
 		RequestPath:   reqPath,
 		RequestMethod: reqMethod,
 		RequestData:   reqData,
+		Extract:       cfg.Extract,
+		HTTPOptions:   cfg.HTTPOptions,
+		Headers:       cfg.Headers,
+		Auth:          cfg.Auth,
 	}
 	if node.Type == "" {
 		node.Type = "default"
@@ -170,132 +204,126 @@ func postFlowNode(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+// runNode 运行节点 POST /nodes/run；带 Idempotency-Key 请求头时，同一逻辑会话内重复的键直接重放首个请求的结果，不再调用上游
 func runNode(c *gin.Context) {
 	var req RunNodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
 		return
 	}
-	if req.Node.Data == nil {
-		req.Node.Data = &RunNodeData{}
-	}
-	nodeID := strings.TrimSpace(req.Node.ID)
-	if nodeID == "" {
-		c.JSON(http.StatusBadRequest, RunNodeResponse{OK: false, Error: "节点 id 不能为空"})
+	in, msg := runNodeInput(req)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, RunNodeResponse{OK: false, Error: msg})
 		return
 	}
-	db := orm.DB()
-	var smNode orm.SMNode
-	if err := db.Where("node_id = ?", nodeID).First(&smNode).Error; err != nil {
-		c.JSON(http.StatusNotFound, RunNodeResponse{OK: false, Error: "节点不存在或未保存到流程"})
+	if !allowFlow(c, in.SMID) {
 		return
 	}
-	var flow orm.SMFlow
-	if err := db.First(&flow, smNode.SMID).Error; err != nil {
-		c.JSON(http.StatusNotFound, RunNodeResponse{OK: false, Error: "所属状态机不存在"})
+	if reason := overrideForbidden(in, currentApiKey(c)); reason != "" {
+		abortForbidden(c, reason)
 		return
 	}
-	baseURL := strings.TrimSuffix(strings.TrimSpace(flow.BaseURL), "/")
-	path := strings.TrimSpace(req.Node.Data.RequestPath)
-	if path != "" && path[0] != '/' {
-		path = "/" + path
-	}
-	url := baseURL + path
-	if baseURL == "" {
-		c.JSON(http.StatusBadRequest, RunNodeResponse{OK: false, Error: "请先配置状态机的 Base URL"})
+	version, ok := expectedVersion(c, req.ExpectedVersion)
+	if !ok {
 		return
 	}
+	in.ExpectedVersion = version
+	code, body, replayed := idempotent(c.Request.Context(), c.GetHeader(idempotencyHeader), runNodeScope(in.SMID, in.SessionID), in, func(ctx context.Context) (int, any) {
+		return execRunNode(ctx, in)
+	})
+	writeIdempotent(c, code, body, replayed)
+}
 
-	method := strings.TrimSpace(strings.ToUpper(req.Node.Data.RequestMethod))
-	if method == "" {
-		method = "GET"
-	}
-
-	var body io.Reader
-	if method != "GET" && req.Node.Data.RequestData != "" {
-		body = bytes.NewBufferString(req.Node.Data.RequestData)
-	}
-	httpReq, err := http.NewRequest(method, url, body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, RunNodeResponse{OK: false, Error: "构建请求失败: " + err.Error()})
-		return
-	}
-	if body != nil {
-		httpReq.Header.Set("Content-Type", "application/json")
-	}
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+// execRunNode 运行节点，返回 HTTP 状态码与响应体
+func execRunNode(ctx context.Context, in engine.RunNodeInput) (int, any) {
+	result, err := engine.Default().RunNode(ctx, in)
 	if err != nil {
-		c.JSON(http.StatusOK, RunNodeResponse{OK: false, Error: "请求失败: " + err.Error()})
-		return
+		// 上游请求失败不视为接口错误，与上游返回非 2xx 一样通过 ok=false 告知前端
+		if errors.Is(err, engine.ErrRequestFailed) {
+			res := RunNodeResponse{OK: false, Error: err.Error()}
+			var reqErr *engine.RequestError
+			if errors.As(err, &reqErr) && reqErr.Response != nil {
+				res.StatusCode, res.Body = reqErr.Response.StatusCode, reqErr.Response.Body
+			}
+			return http.StatusOK, res
+		}
+		return engineErrorStatus(err), RunNodeResponse{OK: false, Error: err.Error()}
 	}
-	defer resp.Body.Close()
-	respBody, _ := io.ReadAll(resp.Body)
-	respBodyStr := string(respBody)
-	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	return http.StatusOK, runNodeResponse(result)
+}
 
-	// 记录会话历史（事务）：会话不存在则创建，按 flowId + nodeId + sessionId 确定唯一，存在则更新
-	tx := db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-	sessionID := req.SessionID
-	var session orm.SessionInfo
-	err = tx.Where("sm_id = ? AND logical_session_id = ?", smNode.SMID, sessionID).First(&session).Error
-	if err != nil {
-		session = orm.SessionInfo{SMID: smNode.SMID, LogicalSessionID: sessionID, State: "", Status: "running"}
-		if err = tx.Create(&session).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, RunNodeResponse{OK: false, Error: "创建会话失败: " + err.Error()})
-			return
-		}
+// runNodeScope 运行节点的幂等键作用域：状态机内的逻辑会话（会话可能尚未创建）
+func runNodeScope(smID, logicalID int64) string {
+	return "flow:" + strconv.FormatInt(smID, 10) + ":session:" + strconv.FormatInt(logicalID, 10)
+}
+
+// runNodeInput 由运行节点请求构造引擎输入，请求中带 data 时覆盖节点保存的请求配置；参数错误时返回错误说明
+func runNodeInput(req RunNodeRequest) (engine.RunNodeInput, string) {
+	smID, err := strconv.ParseInt(strings.TrimSpace(req.StateMachineID), 10, 64)
+	if err != nil || smID <= 0 {
+		return engine.RunNodeInput{}, "无效的 stateMachineId"
 	}
-	reqDataStr := ""
-	if req.Node.Data != nil && req.Node.Data.RequestData != "" {
-		reqDataStr = req.Node.Data.RequestData
-	}
-	detail := orm.SessionDetail{
-		SessionID:    session.ID,
-		NodeID:       nodeID,
-		SMID:         smNode.SMID,
-		Event:        "run_node",
-		FromState:    "",
-		ToState:      nodeID,
-		Path:         path,
-		RequestData:  reqDataStr,
-		ResponseData: respBodyStr,
-	}
-	var existing orm.SessionDetail
-	errDetail := tx.Where("session_id = ? AND node_id = ?", session.ID, nodeID).First(&existing).Error
-	if errDetail != nil {
-		if err = tx.Create(&detail).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, RunNodeResponse{OK: false, Error: "记录会话历史失败: " + err.Error()})
-			return
-		}
-	} else {
-		if err = tx.Model(&existing).Updates(map[string]interface{}{
-			"path":          detail.Path,
-			"request_data":  detail.RequestData,
-			"response_data": detail.ResponseData,
-			"to_state":      detail.ToState,
-		}).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, RunNodeResponse{OK: false, Error: "更新会话历史失败: " + err.Error()})
-			return
+	nodeID := strings.TrimSpace(req.Node.ID)
+	if nodeID == "" {
+		return engine.RunNodeInput{}, "节点 id 不能为空"
+	}
+	in := engine.RunNodeInput{SMID: smID, NodeID: nodeID, SessionID: req.SessionID, ExpectedVersion: req.ExpectedVersion}
+	if req.Node.Data != nil {
+		in.Override = &engine.NodeRequest{
+			RequestPath:   req.Node.Data.RequestPath,
+			RequestMethod: req.Node.Data.RequestMethod,
+			RequestData:   req.Node.Data.RequestData,
 		}
 	}
-	if err = tx.Commit().Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, RunNodeResponse{OK: false, Error: "提交事务失败: " + err.Error()})
-		return
+	return in, ""
+}
+
+// overrideForbidden 校验能否用 node.data 覆盖节点请求，不能时返回原因：只允许设计页会话（sessionId=0）的调试运行，且需要 design 权限。
+// 覆盖后的请求仍会带上流程与节点的认证头、secret 与签名，只有 run 权限的 Key 不能借此改写请求路径与内容
+func overrideForbidden(in engine.RunNodeInput, key *orm.SMApiKey) string {
+	switch {
+	case in.Override == nil:
+		return ""
+	case in.SessionID != 0:
+		return "只有设计页会话（sessionId=0）可以用 node.data 覆盖节点请求"
+	case key != nil && !hasScope(key, scopeDesign):
+		return "用 node.data 覆盖节点请求需要 design 权限"
+	}
+	return ""
+}
+
+// runNodeResponse 将运行结果转换为 RunNodeResponse；节点未发起请求时 ok=true、statusCode=0
+func runNodeResponse(r *engine.EventResult) RunNodeResponse {
+	if r.Response == nil {
+		return RunNodeResponse{OK: true, Version: r.Session.Version}
+	}
+	return RunNodeResponse{
+		OK:         r.Response.OK(),
+		StatusCode: r.Response.StatusCode,
+		Body:       r.Response.Body,
+		Version:    r.Session.Version,
 	}
+}
 
-	c.JSON(http.StatusOK, RunNodeResponse{
-		OK:         ok,
-		StatusCode: resp.StatusCode,
-		Body:       respBodyStr,
-	})
+// engineErrorStatus 将引擎错误映射为 HTTP 状态码
+func engineErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrGuard), errors.Is(err, engine.ErrGuardRejected), errors.Is(err, engine.ErrTemplate),
+		errors.Is(err, engine.ErrScript), errors.Is(err, engine.ErrUnknownExecutor), errors.Is(err, engine.ErrAuth):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, engine.ErrNoBaseURL):
+		return http.StatusBadRequest
+	case errors.Is(err, engine.ErrRequestFailed):
+		return http.StatusBadGateway
+	case errors.Is(err, engine.ErrSessionNotFound), errors.Is(err, engine.ErrNodeNotFound), errors.Is(err, engine.ErrFlowNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrNoStartNode), errors.Is(err, engine.ErrNoTransition),
+		errors.Is(err, engine.ErrAmbiguous), errors.Is(err, engine.ErrInvalidTarget),
+		errors.Is(err, engine.ErrSessionNotRunning), errors.Is(err, engine.ErrLifecycle), errors.Is(err, engine.ErrVersionConflict):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrQueueFull):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
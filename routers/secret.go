@@ -0,0 +1,109 @@
+package routers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/caoaolong/state-server/engine"
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterSecretRoutes 流程密钥：只能写入与删除，列表中的值始终脱敏
+func RegisterSecretRoutes(r *gin.Engine) {
+	g := r.Group("/flow")
+	db := orm.DB()
+
+	// 获取密钥列表 GET /flow/:id/secrets
+	g.GET("/:id/secrets", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		var rows []orm.SMSecret
+		if err := db.Where("sm_id = ?", id).Order("name").Find(&rows).Error; err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list := make([]gin.H, 0, len(rows))
+		for _, r := range rows {
+			list = append(list, gin.H{
+				"name":      r.Name,
+				"value":     engine.MaskSecret(r.Value),
+				"updatedAt": r.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+			})
+		}
+		ctx.JSON(http.StatusOK, gin.H{"list": list})
+	})
+
+	// 创建或更新密钥 PUT /flow/:id/secrets/:name
+	g.PUT("/:id/secrets/:name", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		name := ctx.Param("name")
+		if !engine.ValidSecretName(name) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "密钥名只能包含字母、数字和下划线，且不能以数字开头"})
+			return
+		}
+		if err := db.First(&orm.SMFlow{}, id).Error; err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
+			return
+		}
+		var req struct {
+			Value string `json:"value" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+		var row orm.SMSecret
+		err = db.Where("sm_id = ? AND name = ?", id, name).First(&row).Error
+		if err == nil {
+			err = db.Model(&row).Update("value", req.Value).Error
+		} else {
+			row = orm.SMSecret{SMID: id, Name: name, Value: req.Value}
+			err = db.Create(&row).Error
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"name":      row.Name,
+			"value":     engine.MaskSecret(req.Value),
+			"updatedAt": row.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+		})
+	})
+
+	// 删除密钥 DELETE /flow/:id/secrets/:name
+	g.DELETE("/:id/secrets/:name", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		result := db.Where("sm_id = ? AND name = ?", id, ctx.Param("name")).Delete(&orm.SMSecret{})
+		if result.Error != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if result.RowsAffected == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "密钥不存在"})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+}
@@ -1,10 +1,14 @@
 package routers
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/caoaolong/state-server/engine"
 	"github.com/caoaolong/state-server/orm"
 )
 
@@ -12,11 +16,15 @@ func RegisterSessionRoutes(r *gin.Engine) {
 	g := r.Group("/sessions")
 	db := orm.DB()
 
-	// 创建会话（设计页进入时调用，sessionId 固定为 0 表示设计会话）
+	// 创建会话 POST /sessions：新会话放到流程的开始节点，可带初始会话变量。
+	// sessionId 为 0 表示设计页会话；指定 sessionId 或 externalKey 且会话已存在时返回已有会话（created=false），
+	// 两者都不传时由服务端分配新的逻辑会话 id
 	g.POST("", func(ctx *gin.Context) {
 		var req struct {
-			StateMachineID string `json:"stateMachineId" binding:"required"`
-			SessionID      int64  `json:"sessionId"` // 固定传 0
+			StateMachineID string         `json:"stateMachineId" binding:"required"`
+			SessionID      *int64         `json:"sessionId"`   // 可选：逻辑会话 id，设计页固定传 0
+			ExternalKey    string         `json:"externalKey"` // 可选：外部关联键（如业务单号），同一状态机内唯一
+			Context        map[string]any `json:"context"`     // 可选：初始会话变量
 		}
 		if err := ctx.ShouldBindJSON(&req); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
@@ -27,31 +35,43 @@ func RegisterSessionRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 stateMachineId"})
 			return
 		}
-		logicalID := req.SessionID
-		var flow orm.SMFlow
-		if err := db.First(&flow, smID).Error; err != nil {
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
+		if req.SessionID != nil && req.ExternalKey != "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "sessionId 与 externalKey 不能同时指定"})
 			return
 		}
-		var session orm.SessionInfo
-		err = db.Where("sm_id = ? AND logical_session_id = ?", smID, logicalID).First(&session).Error
+		if len(req.ExternalKey) > 128 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "externalKey 不能超过 128 个字符"})
+			return
+		}
+		if !allowFlow(ctx, smID) {
+			return
+		}
+		session, created, err := engine.Default().CreateSession(ctx.Request.Context(), engine.CreateSessionInput{
+			SMID:        smID,
+			SessionID:   req.SessionID,
+			ExternalKey: req.ExternalKey,
+			Context:     req.Context,
+		})
 		if err != nil {
-			session = orm.SessionInfo{SMID: smID, LogicalSessionID: logicalID, State: "", Status: "running"}
-			if err := db.Create(&session).Error; err != nil {
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			if errors.Is(err, engine.ErrFlowNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
 				return
 			}
+			ctx.JSON(engineErrorStatus(err), gin.H{"error": err.Error()})
+			return
 		}
-		ctx.JSON(http.StatusOK, gin.H{
-			"id":             strconv.FormatInt(session.ID, 10),
-			"sessionId":     session.LogicalSessionID,
-			"stateMachineId": strconv.FormatInt(session.SMID, 10),
-			"status":         session.Status,
-			"createdAt":      session.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
-		})
+		res := sessionInfoJSON(*session)
+		res["sessionId"] = session.LogicalSessionID // 与历史返回格式保持一致，此处为数字
+		res["created"] = created
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		ctx.JSON(status, res)
 	})
 
-	// 获取会话历史（必须写在 GET /:id 之前，否则 /history 会被匹配成 id=history）
+	// 获取会话历史（必须写在 GET /:id 之前，否则 /history 会被匹配成 id=history）；
+	// 历史为追加写入的事件日志，view=latest 时每个会话的每个节点只返回最新一条
 	g.GET("/history", func(ctx *gin.Context) {
 		sessionIdStr := ctx.Query("sessionId")
 		page, _ := strconv.Atoi(ctx.DefaultQuery("page", "1"))
@@ -63,40 +83,45 @@ func RegisterSessionRoutes(r *gin.Engine) {
 			pageSize = 20
 		}
 
-		q := db.Model(&orm.SessionDetail{})
+		q := scopeFlows(ctx, db.Model(&orm.SessionDetail{}), "sm_id")
 		if sessionIdStr != "" {
 			sessionId, err := strconv.ParseInt(sessionIdStr, 10, 64)
 			if err != nil {
 				ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 sessionId"})
 				return
 			}
+			if !allowSession(ctx, sessionId) {
+				return
+			}
 			q = q.Where("session_id = ?", sessionId)
 		}
+		if ctx.Query("view") == "latest" {
+			q = q.Where("seq = (SELECT MAX(d.seq) FROM session_details d WHERE d.session_id = session_details.session_id AND d.node_id = session_details.node_id AND d.deleted_at IS NULL)")
+		}
+		order := "created_at DESC, seq DESC"
+		if sessionIdStr != "" {
+			order = "seq DESC"
+		}
 		var total int64
 		q.Count(&total)
 		var rows []orm.SessionDetail
 		offset := (page - 1) * pageSize
-		if err := q.Order("created_at DESC").Offset(offset).Limit(pageSize).Find(&rows).Error; err != nil {
+		if err := q.Order(order).Offset(offset).Limit(pageSize).Find(&rows).Error; err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
 		list := make([]gin.H, 0, len(rows))
 		for _, r := range rows {
-			list = append(list, gin.H{
-				"id":        strconv.FormatInt(r.ID, 10),
-				"sessionId": strconv.FormatInt(r.SessionID, 10),
-				"nodeId":    r.NodeID,
-				"event":     r.Event,
-				"fromState": r.FromState,
-				"toState":   r.ToState,
-				"createdAt": r.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
-			})
+			list = append(list, sessionDetailJSON(r))
 		}
 		ctx.JSON(http.StatusOK, gin.H{"list": list, "total": total})
 	})
 
-	// 获取会话列表
+	// 订阅会话历史 GET /sessions/:id/stream（SSE）
+	g.GET("/:id/stream", streamSession)
+
+	// 获取会话列表 GET /sessions?stateMachineId=&status=&externalKey=
 	g.GET("", func(ctx *gin.Context) {
 		page, _ := strconv.Atoi(ctx.DefaultQuery("page", "1"))
 		pageSize, _ := strconv.Atoi(ctx.DefaultQuery("pageSize", "10"))
@@ -109,7 +134,7 @@ func RegisterSessionRoutes(r *gin.Engine) {
 			pageSize = 10
 		}
 
-		q := db.Model(&orm.SessionInfo{})
+		q := scopeFlows(ctx, db.Model(&orm.SessionInfo{}), "sm_id")
 		if stateMachineId != "" {
 			smId, err := strconv.ParseInt(stateMachineId, 10, 64)
 			if err != nil {
@@ -121,6 +146,9 @@ func RegisterSessionRoutes(r *gin.Engine) {
 		if status != "" {
 			q = q.Where("status = ?", status)
 		}
+		if key := ctx.Query("externalKey"); key != "" {
+			q = q.Where("external_key = ?", key)
+		}
 		var total int64
 		q.Count(&total)
 		var rows []orm.SessionInfo
@@ -136,13 +164,105 @@ func RegisterSessionRoutes(r *gin.Engine) {
 				"id":             strconv.FormatInt(r.ID, 10),
 				"sessionId":      strconv.FormatInt(r.LogicalSessionID, 10),
 				"stateMachineId": strconv.FormatInt(r.SMID, 10),
+				"externalKey":    externalKey(r),
+				"state":          r.State,
 				"status":         r.Status,
+				"version":        r.Version,
 				"createdAt":      r.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
 			})
 		}
 		ctx.JSON(http.StatusOK, gin.H{"list": list, "total": total})
 	})
 
+	// 向会话投递事件 POST /sessions/:id/events：按事件选出出边，执行目标节点请求并迁移状态；
+	// 带 Idempotency-Key 请求头时，同一会话内重复的键直接重放首个请求的结果；会话版本与期望不一致时返回 409
+	g.POST("/:id/events", func(ctx *gin.Context) {
+		idStr := ctx.Param("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowSession(ctx, id) {
+			return
+		}
+		var req struct {
+			Event           string         `json:"event" binding:"required"`
+			Target          string         `json:"target"` // 可选：显式指定目标节点 id
+			Payload         map[string]any `json:"payload"`
+			ExpectedVersion int64          `json:"expectedVersion"` // 可选：期望的会话版本，也可用 If-Match 请求头
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+		version, ok := expectedVersion(ctx, req.ExpectedVersion)
+		if !ok {
+			return
+		}
+		ev := engine.Event{Name: req.Event, Target: req.Target, Payload: req.Payload, ExpectedVersion: version}
+		code, body, replayed := idempotent(ctx.Request.Context(), ctx.GetHeader(idempotencyHeader), sessionScope(id), ev, func(rctx context.Context) (int, any) {
+			return fireEvent(rctx, id, ev)
+		})
+		writeIdempotent(ctx, code, body, replayed)
+	})
+
+	// 获取会话变量 GET /sessions/:id/context
+	g.GET("/:id/context", func(ctx *gin.Context) {
+		idStr := ctx.Param("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowSession(ctx, id) {
+			return
+		}
+		var s orm.SessionInfo
+		if err := db.First(&s, id).Error; err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"context": engine.DecodeContext(s.Context)})
+	})
+
+	// 更新会话变量 PATCH /sessions/:id/context（JSON Merge Patch：null 删除键，对象递归合并）；
+	// 请求体即补丁，期望的会话版本通过 If-Match 请求头或查询参数 expectedVersion 指定
+	g.PATCH("/:id/context", func(ctx *gin.Context) {
+		idStr := ctx.Param("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowSession(ctx, id) {
+			return
+		}
+		var patch map[string]any
+		if err := ctx.ShouldBindJSON(&patch); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "请求体必须是 JSON 对象: " + err.Error()})
+			return
+		}
+		var queryVersion int64
+		if v := ctx.Query("expectedVersion"); v != "" {
+			if queryVersion, err = strconv.ParseInt(v, 10, 64); err != nil || queryVersion < 1 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 expectedVersion"})
+				return
+			}
+		}
+		version, ok := expectedVersion(ctx, queryVersion)
+		if !ok {
+			return
+		}
+		s, err := engine.Default().PatchContext(ctx.Request.Context(), id, patch, version)
+		if err != nil {
+			ctx.JSON(engineErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		setSessionETag(ctx, *s)
+		ctx.JSON(http.StatusOK, gin.H{"context": engine.DecodeContext(s.Context), "version": s.Version})
+	})
+
 	// 获取单个会话详情
 	g.GET("/:id", func(ctx *gin.Context) {
 		idStr := ctx.Param("id")
@@ -151,18 +271,149 @@ func RegisterSessionRoutes(r *gin.Engine) {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
 			return
 		}
+		if !allowSession(ctx, id) {
+			return
+		}
 		var s orm.SessionInfo
 		if err := db.First(&s, id).Error; err != nil {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
 			return
 		}
-		ctx.JSON(http.StatusOK, gin.H{
-			"id":             strconv.FormatInt(s.ID, 10),
-			"sessionId":      strconv.FormatInt(s.LogicalSessionID, 10),
-			"stateMachineId": strconv.FormatInt(s.SMID, 10),
-			"status":         s.Status,
-			"createdAt":      s.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
-			"updatedAt":      s.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
-		})
+		setSessionETag(ctx, s)
+		ctx.JSON(http.StatusOK, sessionInfoJSON(s))
 	})
+
+	// 会话生命周期 POST /sessions/:id/suspend|resume|end|restart：变更运行状态并记录到会话历史；
+	// 可用 If-Match 请求头或请求体 {"expectedVersion": n} 指定期望的会话版本
+	for _, op := range []string{engine.LifecycleSuspend, engine.LifecycleResume, engine.LifecycleEnd, engine.LifecycleRestart} {
+		g.POST("/:id/"+op, func(ctx *gin.Context) {
+			id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+				return
+			}
+			if !allowSession(ctx, id) {
+				return
+			}
+			var req struct {
+				ExpectedVersion int64 `json:"expectedVersion"`
+			}
+			if ctx.Request.ContentLength != 0 {
+				if err := ctx.ShouldBindJSON(&req); err != nil {
+					ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+					return
+				}
+			}
+			version, ok := expectedVersion(ctx, req.ExpectedVersion)
+			if !ok {
+				return
+			}
+			session, _, err := engine.Default().Lifecycle(ctx.Request.Context(), id, op, version)
+			if err != nil {
+				ctx.JSON(engineErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			setSessionETag(ctx, *session)
+			ctx.JSON(http.StatusOK, sessionInfoJSON(*session))
+		})
+	}
+}
+
+// sessionInfoJSON 单个会话的返回格式（含会话变量）
+func sessionInfoJSON(s orm.SessionInfo) gin.H {
+	return gin.H{
+		"id":             strconv.FormatInt(s.ID, 10),
+		"sessionId":      strconv.FormatInt(s.LogicalSessionID, 10),
+		"stateMachineId": strconv.FormatInt(s.SMID, 10),
+		"externalKey":    externalKey(s),
+		"state":          s.State,
+		"status":         s.Status,
+		"version":        s.Version,
+		"context":        engine.DecodeContext(s.Context),
+		"createdAt":      s.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+		"updatedAt":      s.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+}
+
+// expectedVersion 读取期望的会话版本：请求体中的 expectedVersion 优先，否则取 If-Match 请求头
+// （形如 "3"，与 GET /sessions/:id 返回的 ETag 一致）；都未指定或为 * 时返回 0 表示不校验。格式错误时已写入 400
+func expectedVersion(ctx *gin.Context, body int64) (int64, bool) {
+	if body != 0 {
+		return body, true
+	}
+	v := strings.Trim(strings.TrimPrefix(strings.TrimSpace(ctx.GetHeader("If-Match")), "W/"), `"`)
+	if v == "" || v == "*" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 If-Match，应为会话版本号"})
+		return 0, false
+	}
+	return n, true
+}
+
+// setSessionETag 以会话版本作为 ETag，客户端可原样放入 If-Match
+func setSessionETag(ctx *gin.Context, s orm.SessionInfo) {
+	ctx.Header("ETag", `"`+strconv.FormatInt(s.Version, 10)+`"`)
+}
+
+// externalKey 会话的外部关联键，未指定时为空字符串
+func externalKey(s orm.SessionInfo) string {
+	if s.ExternalKey == nil {
+		return ""
+	}
+	return *s.ExternalKey
+}
+
+// sessionDetailJSON 会话历史记录的返回格式
+func sessionDetailJSON(r orm.SessionDetail) gin.H {
+	return gin.H{
+		"id":           strconv.FormatInt(r.ID, 10),
+		"sessionId":    strconv.FormatInt(r.SessionID, 10),
+		"seq":          r.Seq,
+		"nodeId":       r.NodeID,
+		"event":        r.Event,
+		"fromState":    r.FromState,
+		"toState":      r.ToState,
+		"responseCode": r.ResponseCode,
+		"error":        r.Error,
+		"attempts":     engine.DecodeAttempts(r.Attempts),
+		"input":        r.Input,
+		"output":       r.Output,
+		"createdAt":    r.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+}
+
+// fireEvent 向会话投递事件，返回 HTTP 状态码与响应体
+func fireEvent(ctx context.Context, id int64, ev engine.Event) (int, any) {
+	result, err := engine.Default().Fire(ctx, id, ev)
+	if err != nil {
+		return engineErrorStatus(err), gin.H{"error": err.Error()}
+	}
+	return http.StatusOK, eventResultJSON(result)
+}
+
+// sessionScope 会话事件的幂等键作用域
+func sessionScope(id int64) string {
+	return "session:" + strconv.FormatInt(id, 10)
+}
+
+// eventResultJSON 事件处理结果的返回格式：新状态 + 目标节点的 HTTP 结果
+func eventResultJSON(r *engine.EventResult) gin.H {
+	h := gin.H{
+		"ok":        true,
+		"event":     r.Detail.Event,
+		"fromState": r.Detail.FromState,
+		"state":     r.Session.State,
+		"status":    r.Session.Status,
+		"version":   r.Session.Version,
+		"wait":      r.Wait,
+	}
+	if r.Response != nil {
+		h["ok"] = r.Response.OK()
+		h["statusCode"] = r.Response.StatusCode
+		h["body"] = r.Response.Body
+	}
+	return h
 }
@@ -0,0 +1,112 @@
+package routers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caoaolong/state-server/engine"
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sseBuffer    = 256              // 每个流缓存的待推送通知数，超出后结束该流，由客户端凭 Last-Event-ID 重连补齐
+	sseKeepAlive = 15 * time.Second // 空闲时发送注释行，防止代理断开空闲连接
+)
+
+// streamSession 以 SSE 推送会话的新历史记录与状态变化 GET /sessions/:id/stream：
+//
+//	event: detail  id 为 SessionDetail.ID，data 同会话历史列表中的一项
+//	event: state   状态变化通知，data 同 WebSocket 的 state.changed
+//	event: node.started / node.failed / session.*  对应的通知（生命周期操作先推送其历史记录）
+//	event: resync  客户端消费过慢、通知积压超出缓冲，服务端随即结束该流；客户端应带 Last-Event-ID 重连补齐历史
+//
+// 请求头 Last-Event-ID（或查询参数 lastEventId）给出已收到的最后一条历史记录 id 时，先补发其后的历史记录
+func streamSession(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+		return
+	}
+	if !allowSession(ctx, id) {
+		return
+	}
+	db := orm.DB()
+	if err := db.First(&orm.SessionInfo{}, id).Error; err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return
+	}
+	lastID := ctx.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = ctx.Query("lastEventId")
+	}
+	var after int64 = -1
+	if lastID != "" {
+		if after, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 Last-Event-ID"})
+			return
+		}
+	}
+
+	// 先订阅再补发，避免补发期间产生的记录丢失；补发过的记录在实时通知中跳过
+	notifications, cancel := engine.Default().Bus().SubscribeOrClose(sseBuffer, func(n engine.Notification) bool {
+		return n.SessionID == id
+	})
+	defer cancel()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+
+	replayed := after
+	if after >= 0 {
+		var rows []orm.SessionDetail
+		if err := db.Where("session_id = ? AND id > ?", id, after).Order("id").Find(&rows).Error; err != nil {
+			ctx.Render(-1, sse.Event{Event: "error", Data: gin.H{"error": err.Error()}})
+			return
+		}
+		for _, r := range rows {
+			ctx.Render(-1, sse.Event{Id: strconv.FormatInt(r.ID, 10), Event: "detail", Data: sessionDetailJSON(r)})
+			replayed = r.ID
+		}
+	}
+	ctx.Writer.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	done := ctx.Request.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-keepAlive.C:
+			_, _ = ctx.Writer.WriteString(": ping\n\n")
+		case n, ok := <-notifications:
+			if !ok {
+				// 通知积压被丢弃，此后的推送不再完整：告知客户端并结束流，EventSource 会带 Last-Event-ID 自动重连
+				ctx.Render(-1, sse.Event{Event: "resync", Data: gin.H{"error": "推送积压，请携带 Last-Event-ID 重新连接"}})
+				ctx.Writer.Flush()
+				return
+			}
+			// 节点完成与生命周期操作都会写入会话历史，先推送对应的历史记录
+			if n.DetailID > replayed && n.Type != engine.NotifyStateChanged {
+				var detail orm.SessionDetail
+				if err := db.First(&detail, n.DetailID).Error; err == nil {
+					ctx.Render(-1, sse.Event{Id: strconv.FormatInt(detail.ID, 10), Event: "detail", Data: sessionDetailJSON(detail)})
+				}
+			}
+			switch n.Type {
+			case engine.NotifyNodeFinished:
+			case engine.NotifyStateChanged:
+				ctx.Render(-1, sse.Event{Event: "state", Data: n})
+			default:
+				ctx.Render(-1, sse.Event{Event: n.Type, Data: n})
+			}
+		}
+		ctx.Writer.Flush()
+	}
+}
@@ -0,0 +1,263 @@
+package routers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caoaolong/state-server/engine"
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-gonic/gin"
+)
+
+// webhookJSON Webhook 的返回格式（secret 脱敏）
+func webhookJSON(h orm.SMWebhook) gin.H {
+	events := []string{}
+	for _, ev := range strings.Split(h.Events, ",") {
+		if ev = strings.TrimSpace(ev); ev != "" {
+			events = append(events, ev)
+		}
+	}
+	return gin.H{
+		"id":        strconv.FormatInt(h.ID, 10),
+		"url":       h.URL,
+		"events":    events,
+		"secret":    engine.MaskSecret(h.Secret),
+		"enabled":   h.Enabled,
+		"createdAt": h.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+		"updatedAt": h.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+}
+
+// validateWebhook 校验 Webhook 地址与订阅事件，返回逗号分隔的事件列表
+func validateWebhook(rawURL string, events []string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("url 必须是 http 或 https 地址")
+	}
+	for _, ev := range events {
+		if !slices.Contains(engine.WebhookEvents, ev) {
+			return "", fmt.Errorf("无效的事件 %q，可选值为 %s", ev, strings.Join(engine.WebhookEvents, "、"))
+		}
+	}
+	return strings.Join(slices.Compact(slices.Sorted(slices.Values(events))), ","), nil
+}
+
+func generateWebhookSecret() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// RegisterWebhookRoutes 流程 Webhook：会话创建、状态迁移、结束、失败、挂起时投递签名的 POST 请求，并记录每次投递
+func RegisterWebhookRoutes(r *gin.Engine) {
+	g := r.Group("/flow")
+	db := orm.DB()
+
+	// 获取 Webhook 列表 GET /flow/:id/webhooks
+	g.GET("/:id/webhooks", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		var rows []orm.SMWebhook
+		if err := db.Where("sm_id = ?", id).Order("id").Find(&rows).Error; err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list := make([]gin.H, 0, len(rows))
+		for _, h := range rows {
+			list = append(list, webhookJSON(h))
+		}
+		ctx.JSON(http.StatusOK, gin.H{"list": list})
+	})
+
+	// 创建 Webhook POST /flow/:id/webhooks；未指定 secret 时自动生成，完整 secret 仅此次返回
+	g.POST("/:id/webhooks", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		if err := db.First(&orm.SMFlow{}, id).Error; err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "状态机不存在"})
+			return
+		}
+		var req struct {
+			URL     string   `json:"url" binding:"required"`
+			Events  []string `json:"events"`  // 订阅的事件，默认全部
+			Secret  string   `json:"secret"`  // 签名密钥，默认自动生成
+			Enabled *bool    `json:"enabled"` // 默认启用
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+		events, err := validateWebhook(req.URL, req.Events)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		secret := req.Secret
+		if secret == "" {
+			secret = generateWebhookSecret()
+		}
+		row := orm.SMWebhook{SMID: id, URL: req.URL, Events: events, Secret: secret, Enabled: true}
+		if err := db.Create(&row).Error; err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// enabled 默认值为 true，创建时零值不会写入，停用需单独更新
+		if req.Enabled != nil && !*req.Enabled {
+			db.Model(&row).Update("enabled", false)
+		}
+		res := webhookJSON(row)
+		res["secret"] = secret
+		ctx.JSON(http.StatusOK, res)
+	})
+
+	// 更新 Webhook PUT /flow/:id/webhooks/:hookId，只更新传入的字段
+	g.PUT("/:id/webhooks/:hookId", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		var row orm.SMWebhook
+		if err := db.Where("sm_id = ?", id).First(&row, ctx.Param("hookId")).Error; err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Webhook 不存在"})
+			return
+		}
+		var req struct {
+			URL     *string   `json:"url"`
+			Events  *[]string `json:"events"`
+			Secret  *string   `json:"secret"`
+			Enabled *bool     `json:"enabled"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+		updates := map[string]interface{}{}
+		rawURL, events := row.URL, strings.Split(row.Events, ",")
+		if row.Events == "" {
+			events = nil
+		}
+		if req.URL != nil {
+			rawURL = *req.URL
+		}
+		if req.Events != nil {
+			events = *req.Events
+		}
+		joined, err := validateWebhook(rawURL, events)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["url"], updates["events"] = rawURL, joined
+		if req.Secret != nil && *req.Secret != "" {
+			updates["secret"] = *req.Secret
+		}
+		if req.Enabled != nil {
+			updates["enabled"] = *req.Enabled
+		}
+		if err := db.Model(&row).Updates(updates).Error; err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		db.First(&row, row.ID)
+		ctx.JSON(http.StatusOK, webhookJSON(row))
+	})
+
+	// 删除 Webhook DELETE /flow/:id/webhooks/:hookId；尚未完成的投递随之放弃
+	g.DELETE("/:id/webhooks/:hookId", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		result := db.Where("sm_id = ?", id).Delete(&orm.SMWebhook{}, ctx.Param("hookId"))
+		if result.Error != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if result.RowsAffected == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Webhook 不存在"})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+
+	// 投递记录 GET /flow/:id/webhooks/:hookId/deliveries?status=，按时间倒序分页
+	g.GET("/:id/webhooks/:hookId/deliveries", func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "无效的 id"})
+			return
+		}
+		if !allowFlow(ctx, id) {
+			return
+		}
+		var hook orm.SMWebhook
+		if err := db.Unscoped().Where("sm_id = ?", id).First(&hook, ctx.Param("hookId")).Error; err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Webhook 不存在"})
+			return
+		}
+		page, _ := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+		pageSize, _ := strconv.Atoi(ctx.DefaultQuery("pageSize", "20"))
+		if page < 1 {
+			page = 1
+		}
+		if pageSize < 1 || pageSize > 100 {
+			pageSize = 20
+		}
+		q := db.Model(&orm.SMWebhookDelivery{}).Where("webhook_id = ?", hook.ID)
+		if status := ctx.Query("status"); status != "" {
+			q = q.Where("status = ?", status)
+		}
+		var total int64
+		q.Count(&total)
+		var rows []orm.SMWebhookDelivery
+		if err := q.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&rows).Error; err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list := make([]gin.H, 0, len(rows))
+		for _, d := range rows {
+			list = append(list, gin.H{
+				"id":            strconv.FormatInt(d.ID, 10),
+				"sessionId":     strconv.FormatInt(d.SessionID, 10),
+				"event":         d.Event,
+				"payload":       d.Payload,
+				"status":        d.Status,
+				"attemptCount":  d.AttemptCount,
+				"attempts":      engine.DecodeAttempts(d.Attempts),
+				"responseCode":  d.ResponseCode,
+				"responseBody":  d.ResponseBody,
+				"error":         d.Error,
+				"nextAttemptAt": formatTimePtr(d.NextAttemptAt),
+				"createdAt":     d.CreatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+				"updatedAt":     d.UpdatedAt.Format("2006-01-02T15:04:05.000Z07:00"),
+			})
+		}
+		ctx.JSON(http.StatusOK, gin.H{"list": list, "total": total})
+	})
+}
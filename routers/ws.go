@@ -0,0 +1,268 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/caoaolong/state-server/engine"
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsFrame 客户端发送的消息帧，requestId 原样带回对应的响应帧：
+//
+//	{"type":"subscribe","sessionId":"1"} / {"type":"subscribe","flowId":"2"}
+//	{"type":"unsubscribe","sessionId":"1"} / {"type":"unsubscribe","flowId":"2"}
+//	{"type":"event","requestId":"r1","sessionId":"1","event":"next","target":"","payload":{}}
+//	{"type":"runNode","requestId":"r2","stateMachineId":"1","node":{"id":"n1"},"sessionId":0}
+//	{"type":"ping"}
+//
+// event 与 runNode 帧可带 idempotencyKey，作用与 HTTP 接口的 Idempotency-Key 请求头相同
+type wsFrame struct {
+	Type           string `json:"type"`
+	RequestID      string `json:"requestId"`
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+// wsSubscribeFrame subscribe / unsubscribe 帧
+type wsSubscribeFrame struct {
+	SessionID string `json:"sessionId"`
+	FlowID    string `json:"flowId"`
+}
+
+// wsEventFrame event 帧：向会话投递事件，与 POST /sessions/:id/events 一致
+type wsEventFrame struct {
+	SessionID       string         `json:"sessionId"`
+	Event           string         `json:"event"`
+	Target          string         `json:"target"`
+	Payload         map[string]any `json:"payload"`
+	ExpectedVersion int64          `json:"expectedVersion"`
+}
+
+// match 判断通知是否属于连接订阅的会话或状态机
+func (c *wsConn) match(n engine.Notification) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions[n.SessionID] || c.flows[n.FlowID]
+}
+
+// reply 将响应帧放入发送队列，带上请求的 requestId
+func (c *wsConn) reply(f wsFrame, msg gin.H) {
+	if f.RequestID != "" {
+		msg["requestId"] = f.RequestID
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	c.enqueue(data)
+}
+
+// fail 回复错误帧，status 与对应 HTTP 接口的状态码一致
+func (c *wsConn) fail(f wsFrame, status int, msg string) {
+	c.reply(f, gin.H{"type": "error", "status": status, "error": msg})
+}
+
+// respond 将 HTTP 接口形式的结果转换为响应帧：2xx 为 result 帧，其余为 error 帧；重放的结果带 replayed=true
+func (c *wsConn) respond(f wsFrame, code int, body []byte, replayed bool) {
+	var msg gin.H
+	if err := json.Unmarshal(body, &msg); err != nil || msg == nil {
+		msg = gin.H{}
+	}
+	if code < 200 || code >= 300 {
+		errMsg, _ := msg["error"].(string)
+		c.fail(f, code, errMsg)
+		return
+	}
+	msg["type"] = "result"
+	if replayed {
+		msg["replayed"] = true
+	}
+	c.reply(f, msg)
+}
+
+// allowFlow 校验连接的 API Key 能否访问状态机 smID
+func (c *wsConn) allowFlow(smID int64) bool {
+	if c.key == nil {
+		return true
+	}
+	ids := c.key.FlowIDList()
+	return len(ids) == 0 || slices.Contains(ids, smID)
+}
+
+// allowScope 校验连接的 API Key 是否具备权限范围 scope；未启用鉴权时放行
+func (c *wsConn) allowScope(scope string) bool {
+	return c.key == nil || hasScope(c.key, scope)
+}
+
+// handle 处理一个消息帧。event 与 runNode 在读循环中依次执行，保证同一连接上投递的事件按顺序生效
+func (c *wsConn) handle(data []byte) {
+	var f wsFrame
+	if err := json.Unmarshal(data, &f); err != nil {
+		c.fail(f, http.StatusBadRequest, "消息格式错误: "+err.Error())
+		return
+	}
+	switch f.Type {
+	case "ping":
+		c.reply(f, gin.H{"type": "pong"})
+	case "subscribe", "unsubscribe":
+		c.subscribe(f, data)
+	case "event":
+		c.fire(f, data)
+	case "runNode":
+		c.runNode(f, data)
+	default:
+		c.fail(f, http.StatusBadRequest, "未知的消息类型 "+strconv.Quote(f.Type))
+	}
+}
+
+// subscribe 订阅或取消订阅会话 / 状态机的通知
+func (c *wsConn) subscribe(f wsFrame, data []byte) {
+	var req wsSubscribeFrame
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.fail(f, http.StatusBadRequest, "参数错误: "+err.Error())
+		return
+	}
+	var (
+		target string
+		id     int64
+		err    error
+	)
+	switch {
+	case req.SessionID != "":
+		target = "sessionId"
+		if id, err = strconv.ParseInt(req.SessionID, 10, 64); err != nil {
+			c.fail(f, http.StatusBadRequest, "无效的 sessionId")
+			return
+		}
+		if f.Type == "subscribe" {
+			var s orm.SessionInfo
+			if err := orm.DB().Select("id", "sm_id").First(&s, id).Error; err != nil {
+				c.fail(f, http.StatusNotFound, "会话不存在")
+				return
+			}
+			if !c.allowFlow(s.SMID) {
+				c.fail(f, http.StatusForbidden, "API Key 无权访问该状态机")
+				return
+			}
+		}
+	case req.FlowID != "":
+		target = "flowId"
+		if id, err = strconv.ParseInt(req.FlowID, 10, 64); err != nil {
+			c.fail(f, http.StatusBadRequest, "无效的 flowId")
+			return
+		}
+		if f.Type == "subscribe" {
+			if err := orm.DB().First(&orm.SMFlow{}, id).Error; err != nil {
+				c.fail(f, http.StatusNotFound, "状态机不存在")
+				return
+			}
+			if !c.allowFlow(id) {
+				c.fail(f, http.StatusForbidden, "API Key 无权访问该状态机")
+				return
+			}
+		}
+	default:
+		c.fail(f, http.StatusBadRequest, "需指定 sessionId 或 flowId")
+		return
+	}
+	set := c.sessions
+	if target == "flowId" {
+		set = c.flows
+	}
+	c.mu.Lock()
+	if f.Type == "subscribe" {
+		set[id] = true
+	} else {
+		delete(set, id)
+	}
+	c.mu.Unlock()
+	c.reply(f, gin.H{"type": f.Type + "d", target: strconv.FormatInt(id, 10)})
+}
+
+// fire 向会话投递事件，成功时回复 result 帧（内容同 POST /sessions/:id/events 的响应）
+func (c *wsConn) fire(f wsFrame, data []byte) {
+	if !c.allowScope(scopeRun) {
+		c.fail(f, http.StatusForbidden, "API Key 缺少 run 权限")
+		return
+	}
+	var req wsEventFrame
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.fail(f, http.StatusBadRequest, "参数错误: "+err.Error())
+		return
+	}
+	id, err := strconv.ParseInt(req.SessionID, 10, 64)
+	if err != nil {
+		c.fail(f, http.StatusBadRequest, "无效的 sessionId")
+		return
+	}
+	if req.Event == "" {
+		c.fail(f, http.StatusBadRequest, "event 不能为空")
+		return
+	}
+	var s orm.SessionInfo
+	if err := orm.DB().Select("id", "sm_id").First(&s, id).Error; err == nil && !c.allowFlow(s.SMID) {
+		c.fail(f, http.StatusForbidden, "API Key 无权访问该状态机")
+		return
+	}
+	ev := engine.Event{Name: req.Event, Target: req.Target, Payload: req.Payload, ExpectedVersion: req.ExpectedVersion}
+	code, body, replayed := idempotent(c.reqCtx, f.IdempotencyKey, sessionScope(id), ev, func(ctx context.Context) (int, any) {
+		return fireEvent(ctx, id, ev)
+	})
+	c.respond(f, code, body, replayed)
+}
+
+// runNode 运行节点，成功时回复 result 帧（内容同 POST /nodes/run 的响应）
+func (c *wsConn) runNode(f wsFrame, data []byte) {
+	if !c.allowScope(scopeRun) {
+		c.fail(f, http.StatusForbidden, "API Key 缺少 run 权限")
+		return
+	}
+	var req RunNodeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.fail(f, http.StatusBadRequest, "参数错误: "+err.Error())
+		return
+	}
+	in, msg := runNodeInput(req)
+	if msg != "" {
+		c.fail(f, http.StatusBadRequest, msg)
+		return
+	}
+	if !c.allowFlow(in.SMID) {
+		c.fail(f, http.StatusForbidden, "API Key 无权访问该状态机")
+		return
+	}
+	if reason := overrideForbidden(in, c.key); reason != "" {
+		c.fail(f, http.StatusForbidden, reason)
+		return
+	}
+	code, body, replayed := idempotent(c.reqCtx, f.IdempotencyKey, runNodeScope(in.SMID, in.SessionID), in, func(ctx context.Context) (int, any) {
+		return execRunNode(ctx, in)
+	})
+	c.respond(f, code, body, replayed)
+}
+
+// RegisterWebSocketRoutes 实时推送 GET /ws：客户端订阅会话或状态机后，接收节点开始/完成/失败、状态变化与会话结束通知；
+// 也可在同一连接上投递事件、运行节点，响应按 requestId 对应。
+// 握手经 APIKeyAuth 鉴权（可用 ?apiKey= 传递 Key），并按 cfg 校验 Origin
+func RegisterWebSocketRoutes(r *gin.Engine, cfg WSConfig) {
+	hub := newWSHub(engine.Default().Bus())
+	upgrader := websocket.Upgrader{CheckOrigin: cfg.checkOrigin}
+	r.GET("/ws", func(ctx *gin.Context) {
+		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			log.Println("WebSocket 升级失败:", err)
+			return
+		}
+		c := newWSConn(conn, ctx, cfg.QueueSize)
+		hub.add(c)
+		defer hub.remove(c)
+		go c.writeLoop(cfg.PingInterval)
+		c.readLoop(cfg.PingInterval)
+	})
+}
@@ -0,0 +1,222 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoaolong/state-server/engine"
+	"github.com/caoaolong/state-server/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second // 单次写超时
+	wsMaxFrameSize = 1 << 20          // 客户端单帧上限
+	wsHubBuffer    = 1024             // 集线器从通知总线接收通知的缓冲
+)
+
+// WSConfig WebSocket 连接配置
+type WSConfig struct {
+	Origins      []string      // 允许的 Origin；为空时仅允许同源，"*" 允许任意来源
+	QueueSize    int           // 每个连接的发送队列长度，队列满时断开该连接
+	PingInterval time.Duration // 心跳间隔，超过两个间隔未收到任何消息（含 pong）视为对端失联
+}
+
+// LoadWSConfig 从环境变量读取 WebSocket 配置：
+// SM_WS_ORIGINS 为逗号分隔的允许来源，形如 "https://app.example.com"，"*" 表示不限制；
+// SM_WS_QUEUE 为发送队列长度（默认 256）；SM_WS_PING 为心跳间隔（默认 30s）
+func LoadWSConfig() WSConfig {
+	cfg := WSConfig{QueueSize: 256, PingInterval: 30 * time.Second}
+	for _, item := range strings.Split(os.Getenv("SM_WS_ORIGINS"), ",") {
+		if item = strings.TrimRight(strings.TrimSpace(item), "/"); item != "" {
+			cfg.Origins = append(cfg.Origins, item)
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("SM_WS_QUEUE")); err == nil && n > 0 {
+		cfg.QueueSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("SM_WS_PING")); err == nil && d > 0 {
+		cfg.PingInterval = d
+	}
+	return cfg
+}
+
+// checkOrigin 校验握手请求的 Origin；非浏览器客户端不带 Origin 时放行
+func (cfg WSConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(cfg.Origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range cfg.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsHub 跟踪全部 WebSocket 连接，并将引擎通知分发给订阅了对应会话或状态机的连接
+type wsHub struct {
+	mu    sync.RWMutex
+	conns map[*wsConn]struct{}
+}
+
+// newWSHub 创建集线器并开始分发通知总线上的通知
+func newWSHub(bus *engine.Bus) *wsHub {
+	h := &wsHub{conns: map[*wsConn]struct{}{}}
+	notifications, _ := bus.Subscribe(wsHubBuffer, nil)
+	go h.run(notifications)
+	return h
+}
+
+func (h *wsHub) add(c *wsConn) {
+	h.mu.Lock()
+	h.conns[c] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *wsHub) remove(c *wsConn) {
+	h.mu.Lock()
+	delete(h.conns, c)
+	h.mu.Unlock()
+}
+
+func (h *wsHub) run(notifications <-chan engine.Notification) {
+	for n := range notifications {
+		data, err := json.Marshal(n)
+		if err != nil {
+			continue
+		}
+		h.mu.RLock()
+		for c := range h.conns {
+			if c.match(n) {
+				c.enqueue(data)
+			}
+		}
+		h.mu.RUnlock()
+	}
+}
+
+// wsConn 一个 WebSocket 连接：订阅状态与有界发送队列，所有写操作由写协程串行完成。
+// 握手完成后 gin 会回收 *gin.Context，连接只保存握手时取出的 API Key 副本与请求 ctx
+type wsConn struct {
+	conn      *websocket.Conn
+	key       *orm.SMApiKey   // 握手时的 API Key 副本，未启用鉴权时为 nil
+	reqCtx    context.Context // 握手请求的 ctx
+	mu        sync.Mutex
+	sessions  map[int64]bool
+	flows     map[int64]bool
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSConn(conn *websocket.Conn, ctx *gin.Context, queueSize int) *wsConn {
+	var key *orm.SMApiKey
+	if k := currentApiKey(ctx); k != nil {
+		copied := *k
+		key = &copied
+	}
+	return &wsConn{
+		conn:     conn,
+		key:      key,
+		reqCtx:   ctx.Request.Context(),
+		sessions: map[int64]bool{},
+		flows:    map[int64]bool{},
+		send:     make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// enqueue 将消息放入发送队列；队列已满说明客户端消费过慢，直接断开，由客户端重连后重新同步
+func (c *wsConn) enqueue(data []byte) {
+	select {
+	case <-c.done:
+	case c.send <- data:
+	default:
+		log.Printf("WebSocket 客户端 %s 消费过慢，断开连接", c.conn.RemoteAddr())
+		c.close(websocket.ClosePolicyViolation, "发送队列已满")
+	}
+}
+
+// close 发送关闭帧并关闭连接，可重复调用
+func (c *wsConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		_ = c.conn.Close()
+	})
+}
+
+// keyValid 按握手时的 Key id 重新查询：连接建立后 API Key 被删除、刷新或过期时返回 false；未启用鉴权时始终有效
+func (c *wsConn) keyValid() bool {
+	if c.key == nil {
+		return true
+	}
+	var row orm.SMApiKey
+	if err := orm.DB().Select("id", "key_hash", "expires_at").First(&row, c.key.ID).Error; err != nil {
+		return false
+	}
+	return row.KeyHash == c.key.KeyHash && (row.ExpiresAt == nil || row.ExpiresAt.After(time.Now()))
+}
+
+// writeLoop 写协程：发送队列中的消息与定时心跳，心跳时顺带检查 API Key 是否仍然有效
+func (c *wsConn) writeLoop(pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			if !c.keyValid() {
+				c.close(websocket.ClosePolicyViolation, "API Key 已失效")
+				return
+			}
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// readLoop 读循环：收到任何消息（含 pong）都会延长读超时，超时即视为对端失联
+func (c *wsConn) readLoop(pingInterval time.Duration) {
+	defer c.close(websocket.CloseNormalClosure, "")
+	pongWait := 2 * pingInterval
+	c.conn.SetReadLimit(wsMaxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.handle(data)
+		// event / runNode 可能耗时较长，处理完再延长读超时
+		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+}
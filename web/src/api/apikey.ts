@@ -1,5 +1,5 @@
 /**
- * API Key 管理：列表、创建、刷新、删除、查看明文（复制用）
+ * API Key 管理：列表、创建、刷新、删除（明文仅在创建/刷新时返回一次）
  */
 
 import { http } from "./request";
@@ -7,7 +7,19 @@ import { http } from "./request";
 export interface ApiKeyItem {
   id: string;
   name: string;
+  /** 查找前缀，如 smKey-1a2b3c4d */
+  prefix: string;
   apiKey: string;
+  /** 权限范围：read | design | run | admin */
+  scopes: string[];
+  /** 可访问的状态机 id，空数组表示不限制 */
+  flowIds: string[];
+  /** 过期时间，null 表示永不过期 */
+  expiresAt: string | null;
+  expired: boolean;
+  /** 最近使用时间，null 表示从未使用 */
+  lastUsedAt: string | null;
+  usageCount: number;
   createdAt: string;
 }
 
@@ -39,14 +51,6 @@ export async function refreshApiKey(id: string): Promise<{ apiKey: string }> {
   });
 }
 
-/** 查看完整 Key（用于复制） */
-export async function revealApiKey(id: string): Promise<{ apiKey: string }> {
-  return http<{ apiKey: string }>({
-    method: "GET",
-    url: `${BASE}/api-keys/${id}/reveal`,
-  });
-}
-
 /** 删除 API Key */
 export async function deleteApiKey(id: string): Promise<void> {
   await http<void>({
@@ -7,7 +7,8 @@ export {
   setHttpClient,
   http,
   getApiKey,
-  getApiKeys,
+  setApiKey,
+  authHeaders,
 } from "./request";
 export * from "./flow";
 export * from "./session";
@@ -21,94 +21,43 @@ export interface HttpClient {
   <T = unknown>(config: RequestConfig): Promise<T>;
 }
 
-const API_KEYS_STORAGE_KEY = "state-server-api-keys";
+const API_KEY_STORAGE_KEY = "state-server-api-key";
 
-export interface ApiKeyItem {
-  id: string;
-  name: string;
-  apiKey: string;
-  createdAt: string;
-}
-
-function loadApiKeys(): ApiKeyItem[] {
+/**
+ * 当前请求使用的 API Key：由服务端签发（设置页创建/刷新，或 POST /api-keys），
+ * 用户在设置页粘贴保存到本地，未设置时返回空字符串
+ */
+export function getApiKey(): string {
   try {
-    const raw = localStorage.getItem(API_KEYS_STORAGE_KEY);
-    if (!raw) return [];
-    const list = JSON.parse(raw) as ApiKeyItem[];
-    return Array.isArray(list) ? list : [];
+    return localStorage.getItem(API_KEY_STORAGE_KEY) ?? "";
   } catch {
-    return [];
+    return "";
   }
 }
 
-function saveApiKeys(list: ApiKeyItem[]): void {
-  localStorage.setItem(API_KEYS_STORAGE_KEY, JSON.stringify(list));
+/** 保存当前使用的 API Key；传空字符串表示清除 */
+export function setApiKey(apiKey: string): void {
+  const key = apiKey.trim();
+  if (key) localStorage.setItem(API_KEY_STORAGE_KEY, key);
+  else localStorage.removeItem(API_KEY_STORAGE_KEY);
 }
 
-const API_KEY_PREFIX = "smKey-";
-const API_KEY_TOTAL_LENGTH = 36;
-const API_KEY_RANDOM_LENGTH = API_KEY_TOTAL_LENGTH - API_KEY_PREFIX.length;
-
-/** 生成随机 API Key，格式 smKey-xxx，总长度 32 字符 */
-function generateRandomKey(): string {
-  const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789";
-  let s = "";
-  for (let i = 0; i < API_KEY_RANDOM_LENGTH; i++) s += chars.charAt(Math.floor(Math.random() * chars.length));
-  return API_KEY_PREFIX + s;
-}
-
-/** 获取全部 API Key 列表 */
-export function getApiKeys(): ApiKeyItem[] {
-  return loadApiKeys();
-}
-
-/** 当前请求使用的 API Key（取列表中第一个） */
-export function getApiKey(): string {
-  const list = loadApiKeys();
-  return list.length > 0 ? list[0].apiKey : "";
-}
-
-/** 创建新 API Key，返回新建项（含生成的 key） */
-export function createApiKey(name: string): ApiKeyItem {
-  const list = loadApiKeys();
-  const item: ApiKeyItem = {
-    id: crypto.randomUUID(),
-    name: name.trim() || "未命名",
-    apiKey: generateRandomKey(),
-    createdAt: new Date().toISOString(),
-  };
-  list.unshift(item);
-  saveApiKeys(list);
-  return item;
-}
-
-/** 删除 API Key */
-export function deleteApiKey(id: string): void {
-  const list = loadApiKeys().filter((x) => x.id !== id);
-  saveApiKeys(list);
-}
-
-/** 刷新（重新生成）指定 API Key，返回更新后的项 */
-export function refreshApiKey(id: string): ApiKeyItem | null {
-  const list = loadApiKeys();
-  const idx = list.findIndex((x) => x.id === id);
-  if (idx === -1) return null;
-  list[idx] = { ...list[idx], apiKey: generateRandomKey(), createdAt: new Date().toISOString() };
-  saveApiKeys(list);
-  return list[idx];
+/** 请求头：带上当前 API Key，供不经过 request 的调用（如 fetch 流式读取）使用 */
+export function authHeaders(): Record<string, string> {
+  const apiKey = getApiKey();
+  return apiKey ? { "X-API-Key": apiKey } : {};
 }
 
 /**
  * 网页版：基于 fetch 的实现。
- * 鉴权：从本地读取 API Key，以 X-API-Key 请求头发送。
+ * 鉴权：从本地读取设置页保存的 API Key，以 X-API-Key 请求头发送。
  * 桌面版可替换为调用 window.go.main.App.XXX 等 Wails 绑定，实现同一 HttpClient 接口。
  */
 export const request: HttpClient = async <T = unknown>(config: RequestConfig): Promise<T> => {
   const { method, url, body, headers: customHeaders } = config;
-  const apiKey = getApiKey();
   const headers: Record<string, string> = {
     ...(body != null && { "Content-Type": "application/json" }),
-    ...(apiKey && { "X-API-Key": apiKey }),
+    ...authHeaders(),
     ...customHeaders,
   };
   const res = await fetch(url, {
@@ -116,7 +65,10 @@ export const request: HttpClient = async <T = unknown>(config: RequestConfig): P
     headers: Object.keys(headers).length ? headers : undefined,
     body: body != null ? JSON.stringify(body) : undefined,
   });
-  if (!res.ok) throw new Error(res.statusText);
+  if (!res.ok) {
+    if (res.status === 401) throw new Error("未授权：请在设置页填写服务端签发的 API Key");
+    throw new Error(res.statusText);
+  }
   if (res.status === 204) return undefined as T;
   const text = await res.text();
   return (text ? JSON.parse(text) : undefined) as T;
@@ -6,7 +6,11 @@ export interface SessionListItem {
   id: string;
   sessionId: string;
   stateMachineId: string;
+  /** 外部关联键，未指定时为空字符串 */
+  externalKey: string;
   status: SessionStatus;
+  /** 会话版本，每次更新加一；状态变更接口可通过 If-Match 传入以检测并发冲突 */
+  version: number;
   createdAt: string;
 }
 
@@ -14,6 +18,9 @@ export interface SessionListItem {
 export interface SessionHistoryItem {
   id: string;
   sessionId: string;
+  /** 会话内序号，从 1 开始递增 */
+  seq: number;
+  nodeId: string;
   event: string;
   fromState: string;
   toState: string;
@@ -26,6 +33,7 @@ export interface SessionListRequest {
   pageSize?: number;
   stateMachineId?: string;
   status?: SessionStatus;
+  externalKey?: string;
 }
 
 /** 获取会话列表 - 返回 */
@@ -39,6 +47,8 @@ export interface SessionHistoryRequest {
   sessionId?: string;
   page?: number;
   pageSize?: number;
+  /** latest：每个节点只返回最新一条 */
+  view?: "latest";
 }
 
 /** 获取会话历史 - 返回 */
@@ -53,18 +63,29 @@ const BASE = import.meta.env.VITE_API_BASE ?? "";
 
 /**
  * 创建会话（设计页进入时调用，sessionId 固定为 0）
- * POST /sessions  body: { stateMachineId, sessionId: 0 }
+ * POST /sessions  body: { stateMachineId, sessionId?, externalKey?, context? }
+ * sessionId 与 externalKey 都不传时由服务端分配逻辑会话 id；新会话位于开始节点
  */
 export interface CreateSessionRequest {
   stateMachineId: string;
   sessionId?: number;
+  /** 外部关联键，同一状态机内唯一，已存在时返回该会话 */
+  externalKey?: string;
+  /** 初始会话变量 */
+  context?: Record<string, unknown>;
 }
 
 export interface CreateSessionResponse {
   id: string;
   sessionId: number;
   stateMachineId: string;
+  externalKey: string;
+  state: string;
   status: SessionStatus;
+  version: number;
+  context: Record<string, unknown>;
+  /** 是否为新建的会话 */
+  created: boolean;
   createdAt: string;
 }
 
@@ -72,7 +93,12 @@ export async function createSession(req: CreateSessionRequest): Promise<CreateSe
   return http<CreateSessionResponse>({
     method: "POST",
     url: `${BASE}/sessions`,
-    body: { stateMachineId: req.stateMachineId, sessionId: req.sessionId ?? 0 },
+    body: {
+      stateMachineId: req.stateMachineId,
+      sessionId: req.externalKey ? undefined : (req.sessionId ?? 0),
+      externalKey: req.externalKey,
+      context: req.context,
+    },
   });
 }
 
@@ -88,6 +114,7 @@ export async function getSessionList(
   if (req.pageSize != null) params.set("pageSize", String(req.pageSize));
   if (req.stateMachineId) params.set("stateMachineId", req.stateMachineId);
   if (req.status) params.set("status", req.status);
+  if (req.externalKey) params.set("externalKey", req.externalKey);
   const query = params.toString();
   return http<SessionListResponse>({
     method: "GET",
@@ -106,9 +133,23 @@ export async function getSessionById(sessionId: string): Promise<SessionListItem
   });
 }
 
+/** 会话生命周期操作 */
+export type SessionLifecycleOp = "suspend" | "resume" | "end" | "restart";
+
+/**
+ * 挂起 / 恢复 / 结束 / 重启会话
+ * POST /sessions/:id/suspend|resume|end|restart
+ */
+export async function sessionLifecycle(id: string, op: SessionLifecycleOp): Promise<SessionListItem> {
+  return http<SessionListItem>({
+    method: "POST",
+    url: `${BASE}/sessions/${id}/${op}`,
+  });
+}
+
 /**
  * 获取会话历史记录（可按 sessionId 筛选）
- * GET /sessions/history?sessionId=xxx&page=1&pageSize=20
+ * GET /sessions/history?sessionId=xxx&page=1&pageSize=20&view=latest
  */
 export async function getSessionHistory(
   req: SessionHistoryRequest = {}
@@ -117,6 +158,7 @@ export async function getSessionHistory(
   if (req.sessionId) params.set("sessionId", req.sessionId);
   if (req.page != null) params.set("page", String(req.page));
   if (req.pageSize != null) params.set("pageSize", String(req.pageSize));
+  if (req.view) params.set("view", req.view);
   const query = params.toString();
   return http<SessionHistoryResponse>({
     method: "GET",
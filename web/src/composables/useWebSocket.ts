@@ -1,4 +1,5 @@
 import { ref, type Ref } from "vue";
+import { getApiKey } from "../api/request";
 
 export interface UseWebSocketOptions {
   /** WebSocket 路径，默认 '/ws' */
@@ -45,7 +46,10 @@ export function useWebSocket(options: UseWebSocketOptions = {}): UseWebSocketRet
 
   function getWsUrl(): string {
     const protocol = location.protocol === "https:" ? "wss:" : "ws:";
-    return `${protocol}//${location.host}${path}`;
+    // 浏览器 WebSocket 无法设置请求头，API Key 通过查询参数携带
+    const apiKey = getApiKey();
+    const query = apiKey ? `?apiKey=${encodeURIComponent(apiKey)}` : "";
+    return `${protocol}//${location.host}${path}${query}`;
   }
 
   function connect(): void {